@@ -26,6 +26,16 @@ func main() {
 	log := logger.New(cfg.GoEnv, cfg.LogLevel)
 	db := database.New(log)
 
+	// Encrypt verification emails at rest
+	err := database.SetupEncryption(cfg.VerificationEncryptionKeys, cfg.VerificationHashKey)
+	if err != nil {
+		panic(err)
+	}
+	err = database.EncryptEmails(db, log)
+	if err != nil {
+		panic(err)
+	}
+
 	// AWS
 	acfg, err := awscfg.LoadDefaultConfig(context.TODO(),
 		awscfg.WithRegion(cfg.AWS_REGION),
@@ -36,6 +36,25 @@ type ForkConfig struct {
 	RoleToRemove string `env:"ROLE_TO_REMOVE,required,notEmpty"`
 	RoleToAdd    string `env:"ROLE_TO_ADD,required,notEmpty"`
 
+	// Verification links, the secret falls back to SERVER_AUTH_SECRET
+	ServerPublicURL        string `env:"SERVER_PUBLIC_URL" envDefault:"http://localhost:8080"`
+	VerificationLinkSecret string `env:"VERIFICATION_LINK_SECRET"`
+
+	// Verification emails at rest. The hash key is kept apart from
+	// SERVER_AUTH_SECRET so rotating that doesn't orphan every stored hash
+	VerificationEncryptionKeys string `env:"VERIFICATION_ENCRYPTION_KEYS"` // id:base64 AES-256 keys, newest first
+	VerificationHashKey        string `env:"VERIFICATION_HASH_KEY,required,notEmpty"`
+
+	// Verification emails over SMTP, for guilds using the smtp provider
+	SMTPHost     string `env:"SMTP_HOST"`
+	SMTPPort     int    `env:"SMTP_PORT" envDefault:"587"` // STARTTLS
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	SMTPPassword string `env:"SMTP_PASSWORD"`
+
+	// SES bounce and complaint notifications, subscribe SNS to
+	// {public url}/verify/ses/{token}. Empty disables the endpoint
+	SESNotificationToken string `env:"SES_NOTIFICATION_TOKEN"`
+
 	// QNA Settings
 	FORUM_CHANNEL_ID string `env:"FORUM_CHANNEL_ID,required,notEmpty"`
 }
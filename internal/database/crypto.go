@@ -0,0 +1,305 @@
+package database
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	encryptedPrefix = "enc:"  // enc:<key id>:<base64 nonce and ciphertext>
+	hashedPrefix    = "hmac:" // hmac:<hex>
+)
+
+var ErrUnknownKey = errors.New("value was encrypted with a key that is no longer configured")
+
+// keyring holds the encryption keys, the first being the one new values are
+// encrypted with, and the key of the hash index. Without encryption keys
+// values are stored as is.
+type keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+	hash   []byte
+}
+
+var keys = &keyring{aeads: map[string]cipher.AEAD{}}
+
+func init() {
+	schema.RegisterSerializer("encrypted", encryptedSerializer{})
+}
+
+// SetupEncryption configures field encryption from a comma separated list of
+// id:base64 AES-256 keys, newest first. Older keys are only used to decrypt
+// until EncryptEmails re-encrypts with the newest one.
+func SetupEncryption(encryptionKeys string, hashKey string) error {
+	k := &keyring{aeads: map[string]cipher.AEAD{}, hash: []byte(hashKey)}
+	if len(k.hash) == 0 {
+		return errors.New("a hash key is required")
+	}
+
+	for _, entry := range strings.Split(encryptionKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || strings.Contains(id, ":") {
+			return fmt.Errorf("encryption key %q should be id:base64", entry)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("encryption key %s should be 32 base64 encoded bytes", id)
+		}
+
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+
+		if _, dup := k.aeads[id]; dup {
+			return fmt.Errorf("encryption key %s is listed twice", id)
+		}
+		if k.active == "" {
+			k.active = id
+		}
+		k.aeads[id] = aead
+	}
+
+	keys = k
+	return nil
+}
+
+// Encrypted reports whether new values are encrypted.
+func Encrypted() bool {
+	return keys.active != ""
+}
+
+func encrypt(plain string) (string, error) {
+	if keys.active == "" || plain == "" {
+		return plain, nil
+	}
+
+	aead := keys.aeads[keys.active]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return encryptedPrefix + keys.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt also accepts plain text, left over from before encryption was
+// configured.
+func decrypt(value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+
+	id, encoded, _ := strings.Cut(rest, ":")
+	aead, ok := keys.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt value with key %s: %w", id, err)
+	}
+
+	return string(plain), nil
+}
+
+// EncryptString encrypts a secret stored outside an encrypted field, like
+// inside a module's config.
+func EncryptString(plain string) (string, error) {
+	return encrypt(plain)
+}
+
+// DecryptString reverses EncryptString.
+func DecryptString(value string) (string, error) {
+	return decrypt(value)
+}
+
+// CurrentString reports whether an EncryptString value needs re-encrypting.
+func CurrentString(value string) bool {
+	return currentCiphertext(value)
+}
+
+// currentCiphertext reports whether a stored value is encrypted with the
+// active key, or plain text when encryption is off.
+func currentCiphertext(value string) bool {
+	if value == "" {
+		return true
+	}
+
+	if keys.active == "" {
+		return !strings.HasPrefix(value, encryptedPrefix)
+	}
+
+	return strings.HasPrefix(value, encryptedPrefix+keys.active+":")
+}
+
+// HashAddress is the keyed hash index of an address, case insensitive.
+func HashAddress(address string) string {
+	if address == "" {
+		return ""
+	}
+
+	return keyedHash("address", strings.ToLower(strings.TrimSpace(address)))
+}
+
+// HashCode hashes a verification code for storage.
+func HashCode(code string) string {
+	if code == "" || strings.HasPrefix(code, hashedPrefix) {
+		return code
+	}
+
+	return hashedPrefix + keyedHash("code", code)
+}
+
+// CheckCode compares a code against a stored one, hashed or from before
+// codes were hashed. Empty codes never match.
+func CheckCode(stored string, code string) bool {
+	if stored == "" || code == "" {
+		return false
+	}
+
+	if strings.HasPrefix(stored, hashedPrefix) {
+		code = HashCode(code)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(code)) == 1
+}
+
+// keyedHash separates hashes of different kinds of values by purpose.
+func keyedHash(purpose string, value string) string {
+	mac := hmac.New(sha256.New, keys.hash)
+	mac.Write([]byte(purpose + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BeforeSave keeps the address hash in sync and makes sure codes are never
+// stored in plain text.
+func (e *Email) BeforeSave(tx *gorm.DB) error {
+	e.AddressHash = HashAddress(e.Address)
+	e.Code = HashCode(e.Code)
+	return nil
+}
+
+// encryptedSerializer stores string fields encrypted with the active key.
+type encryptedSerializer struct{}
+
+func (encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	value := ""
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return fmt.Errorf("unsupported encrypted value of type %T", dbValue)
+	}
+
+	plain, err := decrypt(value)
+	if err != nil {
+		return err
+	}
+
+	return field.Set(ctx, dst, plain)
+}
+
+func (encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plain, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("unsupported encrypted field of type %T", fieldValue)
+	}
+
+	return encrypt(plain)
+}
+
+// EncryptEmails brings every stored email up to date with the configured
+// keys, encrypting plain text addresses, re-encrypting those of older keys
+// and rebuilding stale hashes. Codes are hashed on save.
+func EncryptEmails(db *gorm.DB, log *zerolog.Logger) error {
+	type raw struct {
+		ID             uint
+		Address        string
+		AddressHash    string
+		PendingAddress string
+		Code           string
+	}
+
+	rows := []raw{}
+	err := db.Model(&Email{}).Select("id, address, address_hash, pending_address, code").Find(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	updated := 0
+	for _, row := range rows {
+		plain, err := decrypt(row.Address)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt email %d: %w", row.ID, err)
+		}
+
+		stale := !currentCiphertext(row.Address) ||
+			!currentCiphertext(row.PendingAddress) ||
+			row.AddressHash != HashAddress(plain) ||
+			row.Code != HashCode(row.Code)
+		if !stale {
+			continue
+		}
+
+		email := &Email{}
+		err = db.First(email, row.ID).Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Save(email).Error
+		if err != nil {
+			return fmt.Errorf("unable to re-encrypt email %d: %w", row.ID, err)
+		}
+		updated++
+	}
+
+	if !Encrypted() {
+		log.Warn().Msg("No encryption keys configured, verification emails are stored in plain text")
+	}
+
+	if updated > 0 {
+		log.Info().Int("emails", updated).Msg("Re-encrypted verification emails")
+	}
+
+	return nil
+}
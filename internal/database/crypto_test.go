@@ -0,0 +1,338 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testHashKey = "hash-key"
+
+// testKey is a base64 AES-256 key filled with one byte.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+// setupKeys configures encryption for a test, restoring the keys after.
+func setupKeys(t *testing.T, encryptionKeys string) {
+	t.Helper()
+
+	prev := keys
+	t.Cleanup(func() { keys = prev })
+
+	err := SetupEncryption(encryptionKeys, testHashKey)
+	if err != nil {
+		t.Fatalf("SetupEncryption: %v", err)
+	}
+}
+
+func TestSetupEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		hashKey string
+		wantErr bool
+	}{
+		{name: "no keys", keys: "", hashKey: testHashKey},
+		{name: "one key", keys: "a:" + testKey('a'), hashKey: testHashKey},
+		{name: "rotated keys", keys: "b:" + testKey('b') + ", a:" + testKey('a'), hashKey: testHashKey},
+		{name: "missing hash key", keys: "a:" + testKey('a'), wantErr: true},
+		{name: "missing id", keys: testKey('a'), hashKey: testHashKey, wantErr: true},
+		{name: "short key", keys: "a:" + base64.StdEncoding.EncodeToString([]byte("short")), hashKey: testHashKey, wantErr: true},
+		{name: "not base64", keys: "a:!!!", hashKey: testHashKey, wantErr: true},
+		{name: "duplicate id", keys: "a:" + testKey('a') + ",a:" + testKey('b'), hashKey: testHashKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := keys
+			t.Cleanup(func() { keys = prev })
+
+			err := SetupEncryption(tt.keys, tt.hashKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetupEncryption: got %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		keys       string
+		plain      string
+		wantPrefix string
+	}{
+		{name: "encrypted", keys: "a:" + testKey('a'), plain: "sparky@asu.edu", wantPrefix: encryptedPrefix + "a:"},
+		{name: "newest key", keys: "b:" + testKey('b') + ",a:" + testKey('a'), plain: "sparky@asu.edu", wantPrefix: encryptedPrefix + "b:"},
+		{name: "multi-byte", keys: "a:" + testKey('a'), plain: "spärky🔱@asu.edu", wantPrefix: encryptedPrefix + "a:"},
+		{name: "empty stays empty", keys: "a:" + testKey('a'), plain: ""},
+		{name: "plain without keys", keys: "", plain: "sparky@asu.edu"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupKeys(t, tt.keys)
+
+			sealed, err := EncryptString(tt.plain)
+			if err != nil {
+				t.Fatalf("EncryptString: %v", err)
+			}
+
+			if tt.wantPrefix == "" && sealed != tt.plain {
+				t.Errorf("got %q, want it stored as is", sealed)
+			}
+			if tt.wantPrefix != "" && (!strings.HasPrefix(sealed, tt.wantPrefix) || strings.Contains(sealed, tt.plain)) {
+				t.Errorf("got %q, want ciphertext prefixed %q", sealed, tt.wantPrefix)
+			}
+
+			if !CurrentString(sealed) {
+				t.Errorf("fresh value %q isn't current", sealed)
+			}
+
+			plain, err := DecryptString(sealed)
+			if err != nil {
+				t.Fatalf("DecryptString: %v", err)
+			}
+			if plain != tt.plain {
+				t.Errorf("got %q, want %q", plain, tt.plain)
+			}
+		})
+	}
+}
+
+func TestDecryptAfterRotation(t *testing.T) {
+	setupKeys(t, "a:"+testKey('a'))
+	old, err := EncryptString("sparky@asu.edu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		keys        string
+		value       string
+		wantPlain   string
+		wantCurrent bool
+		wantErr     error
+	}{
+		{name: "old key kept", keys: "b:" + testKey('b') + ",a:" + testKey('a'), value: old, wantPlain: "sparky@asu.edu"},
+		{name: "old key still active", keys: "a:" + testKey('a'), value: old, wantPlain: "sparky@asu.edu", wantCurrent: true},
+		{name: "old key dropped", keys: "b:" + testKey('b'), value: old, wantErr: ErrUnknownKey},
+		{name: "legacy plain text", keys: "b:" + testKey('b'), value: "sparky@asu.edu", wantPlain: "sparky@asu.edu"},
+		{name: "ciphertext after encryption is turned off", keys: "", value: old, wantErr: ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupKeys(t, tt.keys)
+
+			if current := CurrentString(tt.value); current != tt.wantCurrent {
+				t.Errorf("CurrentString: got %t, want %t", current, tt.wantCurrent)
+			}
+
+			plain, err := DecryptString(tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecryptString: got %v, want %v", err, tt.wantErr)
+			}
+			if plain != tt.wantPlain {
+				t.Errorf("got %q, want %q", plain, tt.wantPlain)
+			}
+		})
+	}
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	setupKeys(t, "a:"+testKey('a'))
+
+	sealed, err := EncryptString("sparky@asu.edu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a character of the ciphertext so it fails authentication
+	tampered := []byte(sealed)
+	i := len(tampered) - 3
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "tampered", value: string(tampered)},
+		{name: "not base64", value: encryptedPrefix + "a:!!!"},
+		{name: "shorter than a nonce", value: encryptedPrefix + "a:" + base64.StdEncoding.EncodeToString([]byte("x"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecryptString(tt.value)
+			if err == nil {
+				t.Fatal("DecryptString: got no error")
+			}
+		})
+	}
+}
+
+func TestHashes(t *testing.T) {
+	setupKeys(t, "")
+
+	hashed := HashCode("123456")
+
+	tests := []struct {
+		name   string
+		stored string
+		code   string
+		want   bool
+	}{
+		{name: "hashed code", stored: hashed, code: "123456", want: true},
+		{name: "wrong code", stored: hashed, code: "654321"},
+		{name: "legacy plain text code", stored: "123456", code: "123456", want: true},
+		{name: "wrong legacy code", stored: "123456", code: "654321"},
+		{name: "hash given as the code", stored: hashed, code: hashed, want: true},
+		{name: "no stored code", stored: "", code: ""},
+		{name: "empty code", stored: hashed, code: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckCode(tt.stored, tt.code); got != tt.want {
+				t.Errorf("CheckCode(%q, %q): got %t, want %t", tt.stored, tt.code, got, tt.want)
+			}
+		})
+	}
+
+	if HashCode(hashed) != hashed {
+		t.Error("HashCode isn't idempotent")
+	}
+	if HashCode("") != "" {
+		t.Error("HashCode hashed an empty code")
+	}
+
+	if HashAddress(" Sparky@ASU.edu ") != HashAddress("sparky@asu.edu") {
+		t.Error("HashAddress isn't case and space insensitive")
+	}
+	if HashAddress("123456") == strings.TrimPrefix(hashed, hashedPrefix) {
+		t.Error("address and code hashes aren't separated by purpose")
+	}
+
+	// Hashes only match under the same key
+	prev := HashAddress("sparky@asu.edu")
+	err := SetupEncryption("", "another-hash-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashAddress("sparky@asu.edu") == prev {
+		t.Error("hash doesn't depend on the hash key")
+	}
+}
+
+func TestEncryptEmails(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "forkman.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&Email{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows from before encryption, with plain text codes and no hashes
+	setupKeys(t, "")
+	err = db.Exec("INSERT INTO emails (guild_snowflake, user_snowflake, address, code, is_verified) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)",
+		"100", "200", "sparky@asu.edu", "", true,
+		"100", "201", "pending@asu.edu", "123456", false,
+	).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type raw struct {
+		UserSnowflake string
+		Address       string
+		AddressHash   string
+		Code          string
+	}
+	readRaw := func() map[string]raw {
+		rows := []raw{}
+		err := db.Model(&Email{}).Select("user_snowflake, address, address_hash, code").Find(&rows).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		byUser := map[string]raw{}
+		for _, row := range rows {
+			byUser[row.UserSnowflake] = row
+		}
+		return byUser
+	}
+
+	log := zerolog.Nop()
+	steps := []struct {
+		name       string
+		keys       string
+		wantPrefix string
+	}{
+		{name: "encryption turned on", keys: "a:" + testKey('a'), wantPrefix: encryptedPrefix + "a:"},
+		{name: "key rotated", keys: "b:" + testKey('b') + ",a:" + testKey('a'), wantPrefix: encryptedPrefix + "b:"},
+		{name: "old key dropped", keys: "b:" + testKey('b'), wantPrefix: encryptedPrefix + "b:"},
+	}
+
+	for _, step := range steps {
+		err := SetupEncryption(step.keys, testHashKey)
+		if err != nil {
+			t.Fatalf("%s: SetupEncryption: %v", step.name, err)
+		}
+
+		err = EncryptEmails(db, &log)
+		if err != nil {
+			t.Fatalf("%s: EncryptEmails: %v", step.name, err)
+		}
+
+		rows := readRaw()
+		for user, address := range map[string]string{"200": "sparky@asu.edu", "201": "pending@asu.edu"} {
+			row := rows[user]
+			if !strings.HasPrefix(row.Address, step.wantPrefix) {
+				t.Errorf("%s: address %q isn't encrypted with the newest key", step.name, row.Address)
+			}
+			if row.AddressHash != HashAddress(address) {
+				t.Errorf("%s: address hash %q is stale", step.name, row.AddressHash)
+			}
+		}
+
+		if !CheckCode(rows["201"].Code, "123456") || !strings.HasPrefix(rows["201"].Code, hashedPrefix) {
+			t.Errorf("%s: code %q isn't hashed or no longer matches", step.name, rows["201"].Code)
+		}
+	}
+
+	// Every email still reads back, and a repeat run has nothing to do
+	emails := []Email{}
+	err = db.Order("user_snowflake").Find(&emails).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 || emails[0].Address != "sparky@asu.edu" || emails[1].Address != "pending@asu.edu" {
+		t.Errorf("got %+v, want both addresses decrypted", emails)
+	}
+
+	before := readRaw()
+	err = EncryptEmails(db, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := readRaw(); after["200"] != before["200"] || after["201"] != before["201"] {
+		t.Error("a repeat run rewrote current emails")
+	}
+}
@@ -62,6 +62,18 @@ func New(log *zerolog.Logger) *gorm.DB {
 		&Module{},
 		&Guild{},
 		&Email{},
+		&UnverifiedReminder{},
+		&VerificationReview{},
+		&VerificationPanel{},
+		&VerificationEvent{},
+		&TrustGroup{},
+		&TrustGroupMember{},
+		&VerificationSend{},
+		&MailFeedback{},
+		&QNAThread{},
+		&QNAEscalation{},
+		&QNAInteraction{},
+		&FaqEntry{},
 	}
 
 	// Auto migrate the database
@@ -71,5 +83,13 @@ func New(log *zerolog.Logger) *gorm.DB {
 		panic(err)
 	}
 
+	// Replaced by idx_email_guild_address_hash once addresses were encrypted
+	if db.Migrator().HasIndex(&Email{}, "idx_email_guild_address") {
+		err = db.Migrator().DropIndex(&Email{}, "idx_email_guild_address")
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	return db
 }
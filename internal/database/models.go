@@ -45,11 +45,159 @@ type Module struct {
 
 type Email struct {
 	ID             uint   `gorm:"primarykey;autoIncrement"`
-	GuildSnowflake string `gorm:"index"`
+	GuildSnowflake string `gorm:"index;index:idx_email_guild_address_hash"`
 	UserSnowflake  string
-	Address        string
-	Code           string
+	Address        string `gorm:"serializer:encrypted"`               // Encrypted when keys are configured
+	AddressHash    string `gorm:"index:idx_email_guild_address_hash"` // Keyed hash of the address for lookups
+	PendingAddress string `gorm:"serializer:encrypted"`               // Sent a code, replaces Address once the code comes back
+	Code           string // Stored hashed, see CheckCode
 	IsVerified     bool
+	Provider       string         // How the address was proven, empty for older emails
+	Subject        string         // Identity provider user ID for SSO
+	Claims         datatypes.JSON // Identity provider claims for SSO
+	VerifiedAt     *time.Time     // Last verification, kept while re-verifying
+	Reminders      int            // Re-verification reminders sent since VerifiedAt
+	RemindedAt     *time.Time
+	TrustedFrom    string    `gorm:"index"` // Guild the verification was trusted from, empty when proven here
 	CreatedAt      time.Time // Managed by GORM
 	UpdatedAt      time.Time // Managed by GORM
 }
+
+// UnverifiedReminder records that a member who never verified was reminded.
+type UnverifiedReminder struct {
+	ID             uint      `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake string    `gorm:"uniqueIndex:idx_unverified_guild_user"`
+	UserSnowflake  string    `gorm:"uniqueIndex:idx_unverified_guild_user"`
+	CreatedAt      time.Time // Managed by GORM
+}
+
+// VerificationReview is a request to be verified by staff instead of by email.
+type VerificationReview struct {
+	ID                uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake    string `gorm:"index"`
+	UserSnowflake     string `gorm:"index"`
+	MessageSnowflake  string `gorm:"index"` // Review embed in the staff channel
+	Name              string
+	AlternateEmail    string
+	Note              string
+	Status            string `gorm:"index"`
+	ReviewerSnowflake string
+	Decision          string // Denial reason or question for the user
+	ReviewedAt        *time.Time
+	CreatedAt         time.Time // Managed by GORM
+	UpdatedAt         time.Time // Managed by GORM
+}
+
+// VerificationPanel is the panel message last sent in a guild.
+type VerificationPanel struct {
+	ID               uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake   string `gorm:"uniqueIndex"`
+	ChannelSnowflake string
+	MessageSnowflake string
+	CreatedAt        time.Time // Managed by GORM
+	UpdatedAt        time.Time // Managed by GORM
+}
+
+// VerificationEvent is a step of the verification funnel.
+type VerificationEvent struct {
+	ID             uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake string `gorm:"index:idx_verification_event_guild_time"`
+	UserSnowflake  string
+	Kind           string
+	CreatedAt      time.Time `gorm:"index:idx_verification_event_guild_time"` // Managed by GORM
+}
+
+// VerificationSend is a verification email sent, kept to rate limit sends.
+type VerificationSend struct {
+	ID             uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake string `gorm:"index:idx_verification_send_guild_time"`
+	UserSnowflake  string
+	AddressHash    string    `gorm:"index"`                                        // See HashAddress
+	CreatedAt      time.Time `gorm:"index;index:idx_verification_send_guild_time"` // Managed by GORM
+}
+
+// MailFeedback is a bounce or complaint about a sent email, from any guild.
+type MailFeedback struct {
+	ID          uint `gorm:"primarykey;autoIncrement"`
+	Kind        string
+	AddressHash string
+	CreatedAt   time.Time `gorm:"index"` // Managed by GORM
+}
+
+// TrustGroup is a set of guilds trusting each other's verifications.
+type TrustGroup struct {
+	ID             uint `gorm:"primarykey;autoIncrement"`
+	Name           string
+	OwnerSnowflake string             // Guild that created the group and manages its members
+	Members        []TrustGroupMember `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE"`
+	CreatedAt      time.Time          // Managed by GORM
+	UpdatedAt      time.Time          // Managed by GORM
+}
+
+// TrustGroupMember is a guild invited to a trust group, trusted by the other
+// members once it accepts.
+type TrustGroupMember struct {
+	ID             uint   `gorm:"primarykey;autoIncrement"`
+	GroupID        uint   `gorm:"uniqueIndex:idx_trust_group_guild"`
+	GuildSnowflake string `gorm:"uniqueIndex:idx_trust_group_guild;index"`
+	Accepted       bool
+	CreatedAt      time.Time // Managed by GORM
+	UpdatedAt      time.Time // Managed by GORM
+}
+
+type QNAThread struct {
+	ID               uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake   string `gorm:"index"`
+	ChannelSnowflake string `gorm:"uniqueIndex"`
+	AskerSnowflake   string
+	SessionID        string
+	Turns            int
+	Closed           bool
+	Archived         bool
+	SolvedAt         *time.Time
+	CreatedAt        time.Time // Managed by GORM
+	UpdatedAt        time.Time // Managed by GORM
+}
+
+type QNAEscalation struct {
+	ID                 uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake     string `gorm:"index"`
+	ChannelSnowflake   string `gorm:"index"`
+	MessageSnowflake   string `gorm:"index"`
+	RequesterSnowflake string
+	HelperSnowflake    string
+	Status             string `gorm:"index"`
+	Reminders          int
+	RemindedAt         *time.Time
+	ClaimedAt          *time.Time
+	ResolvedAt         *time.Time
+	CreatedAt          time.Time // Managed by GORM
+	UpdatedAt          time.Time // Managed by GORM
+}
+
+type QNAInteraction struct {
+	ID               uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake   string `gorm:"index"`
+	ForumSnowflake   string `gorm:"index"` // Empty when asked outside the QnA forum
+	ChannelSnowflake string `gorm:"index"`
+	UserSnowflake    string
+	Question         string
+	Answer           string
+	Accepted         bool
+	InputTokens      int
+	OutputTokens     int
+	Estimated        bool      // Token counts estimated from characters
+	CreatedAt        time.Time // Managed by GORM
+	UpdatedAt        time.Time // Managed by GORM
+}
+
+type FaqEntry struct {
+	ID             uint   `gorm:"primarykey;autoIncrement"`
+	GuildSnowflake string `gorm:"uniqueIndex:idx_faq_guild_key"`
+	Key            string `gorm:"uniqueIndex:idx_faq_guild_key"`
+	Title          string
+	Body           string                      // Markdown
+	Aliases        datatypes.JSONSlice[string] // Alternative keys for lookup and autocomplete
+	CreatedAt      time.Time                   // Managed by GORM
+	UpdatedAt      time.Time                   // Managed by GORM
+}
@@ -2,6 +2,7 @@ package discord
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/avvo-na/forkman/common/config"
 	"github.com/avvo-na/forkman/internal/database"
@@ -21,8 +22,10 @@ type Discord struct {
 	db           *gorm.DB
 	log          *zerolog.Logger
 	cfg          *config.ForkConfig
-	email        *ses.Client
+	email        *verification.Mailer
 	bedrock      *bedrockagentruntime.Client
+	quit         chan struct{}
+	mu           sync.RWMutex                          /* Guards the module stores */
 	moderation   map[string]*moderation.Moderation     /* GuildID -> module*/
 	verification map[string]*verification.Verification /* GuildID -> module */
 	qna          map[string]*qna.QNA                   /* GuildID -> module */
@@ -30,13 +33,29 @@ type Discord struct {
 
 var ErrModuleNotFound = errors.New("module not found")
 
+// newMailer sends verification emails through SES, and SMTP when configured.
+func newMailer(cfg *config.ForkConfig, acfg aws.Config) *verification.Mailer {
+	m := &verification.Mailer{SES: ses.NewFromConfig(acfg)}
+	if cfg.SMTPHost != "" {
+		m.SMTP = &verification.SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		}
+	}
+
+	return m
+}
+
 func New(cfg *config.ForkConfig, log *zerolog.Logger, db *gorm.DB, acfg aws.Config) *Discord {
 	d := &Discord{
 		db:      db,
 		log:     log,
 		cfg:     cfg,
-		email:   ses.NewFromConfig(acfg),
+		email:   newMailer(cfg, acfg),
 		bedrock: bedrockagentruntime.NewFromConfig(acfg),
+		quit:    make(chan struct{}),
 	}
 
 	s, err := discordgo.New("Bot " + cfg.DiscordBotToken)
@@ -60,6 +79,7 @@ func New(cfg *config.ForkConfig, log *zerolog.Logger, db *gorm.DB, acfg aws.Conf
 	s.AddHandler(d.onGuildCreateGuildUpdate)
 	s.AddHandler(d.onInteractionCreate)
 	s.AddHandler(d.onMessageCreate)
+	s.AddHandler(d.onThreadUpdate)
 
 	// Open the session
 	log.Info().Msg("Opening discord session")
@@ -68,6 +88,9 @@ func New(cfg *config.ForkConfig, log *zerolog.Logger, db *gorm.DB, acfg aws.Conf
 		panic(err)
 	}
 
+	// Periodic module upkeep
+	go d.runScheduler()
+
 	return d
 }
 
@@ -81,6 +104,8 @@ func (d *Discord) Open() error {
 }
 
 func (d *Discord) Close() error {
+	close(d.quit)
+
 	err := d.session.Close()
 	if err != nil {
 		return err
@@ -94,7 +119,9 @@ func (d *Discord) GetSession() *discordgo.Session {
 }
 
 func (d *Discord) GetQNAModule(guildSnowflake string) (*qna.QNA, error) {
+	d.mu.RLock()
 	mod, ok := d.qna[guildSnowflake]
+	d.mu.RUnlock()
 	if !ok {
 		return nil, ErrModuleNotFound
 	}
@@ -103,7 +130,9 @@ func (d *Discord) GetQNAModule(guildSnowflake string) (*qna.QNA, error) {
 }
 
 func (d *Discord) GetModerationModule(guildSnowflake string) (*moderation.Moderation, error) {
+	d.mu.RLock()
 	mod, ok := d.moderation[guildSnowflake]
+	d.mu.RUnlock()
 	if !ok {
 		return nil, ErrModuleNotFound
 	}
@@ -112,7 +141,9 @@ func (d *Discord) GetModerationModule(guildSnowflake string) (*moderation.Modera
 }
 
 func (d *Discord) GetVerificationModule(guildSnowflake string) (*verification.Verification, error) {
+	d.mu.RLock()
 	mod, ok := d.verification[guildSnowflake]
+	d.mu.RUnlock()
 	if !ok {
 		return nil, ErrModuleNotFound
 	}
@@ -195,7 +226,12 @@ func (d *Discord) onGuildCreateGuildUpdate(s *discordgo.Session, g *discordgo.Gu
 		return
 	}
 
-	v := verification.New(g.Name, g.ID, d.cfg.DiscordAppID, d.session, d.db, d.email, d.log)
+	linkSecret := d.cfg.VerificationLinkSecret
+	if linkSecret == "" {
+		linkSecret = d.cfg.ServerAuthSecret
+	}
+
+	v := verification.New(g.Name, g.ID, d.cfg.DiscordAppID, d.session, d.db, d.email, d.cfg.ServerPublicURL, []byte(linkSecret), d.GetVerificationModule, d.log)
 	if err := v.Load(); err != nil {
 		log.Error().Err(err).Msg("critical error init verification module")
 		return
@@ -207,17 +243,21 @@ func (d *Discord) onGuildCreateGuildUpdate(s *discordgo.Session, g *discordgo.Gu
 		return
 	}
 
+	d.mu.Lock()
 	d.moderation[g.ID] = m
 	d.verification[g.ID] = v
 	d.qna[g.ID] = q
+	d.mu.Unlock()
 
 	log.Debug().Msg("guild instantiation complete")
 }
 
 func (d *Discord) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	d.mu.RLock()
 	go d.moderation[i.GuildID].OnInteractionCreate(s, i)
 	go d.verification[i.GuildID].OnInteractionCreate(s, i)
 	go d.qna[i.GuildID].OnInteractionCreate(s, i)
+	d.mu.RUnlock()
 
 	log := d.log.With().
 		Str("guild_id", i.GuildID).
@@ -260,5 +300,20 @@ func (d *Discord) onInteractionCreate(s *discordgo.Session, i *discordgo.Interac
 }
 
 func (d *Discord) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	go d.qna[m.GuildID].OnMessageCreate(s, m)
 }
+
+func (d *Discord) onThreadUpdate(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	mod, ok := d.qna[t.GuildID]
+	if !ok {
+		return
+	}
+
+	go mod.OnThreadUpdate(s, t)
+}
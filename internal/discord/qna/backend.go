@@ -0,0 +1,160 @@
+package qna
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Turn is a single message of a QnA conversation.
+type Turn struct {
+	Role    string
+	Content string
+}
+
+// Prompt is everything a backend needs to answer a question. Backends that keep
+// their own conversation state use SessionID, others replay History. System
+// holds the guild's instructions for the model.
+type Prompt struct {
+	Question  string
+	SessionID string
+	History   []Turn
+	System    string
+}
+
+type Answer struct {
+	Text         string
+	SessionID    string
+	InputTokens  int // 0 when the backend doesn't report usage
+	OutputTokens int
+	Estimated    bool
+}
+
+type Backend interface {
+	Generate(ctx context.Context, prompt *Prompt) (*Answer, error)
+	Render(prompt *Prompt) string // The final prompt, for previews
+}
+
+type BedrockBackend struct {
+	client          *bedrockagentruntime.Client
+	knowledgeBaseId string
+	modelArn        string
+}
+
+var ErrEmptyAnswer = errors.New("backend returned an empty answer")
+
+func NewBedrockBackend(client *bedrockagentruntime.Client, knowledgeBaseId string) *BedrockBackend {
+	return &BedrockBackend{
+		client:          client,
+		knowledgeBaseId: knowledgeBaseId,
+		modelArn:        "us.anthropic.claude-3-5-sonnet-20241022-v2:0",
+	}
+}
+
+func (b *BedrockBackend) Generate(ctx context.Context, prompt *Prompt) (*Answer, error) {
+	// Bedrock sessions expire, so if the stored one is gone we fall back
+	// to replaying the thread history as part of the query
+	if prompt.SessionID != "" {
+		ans, err := b.retrieveAndGenerate(ctx, prompt.Question, prompt.System, prompt.SessionID)
+		if err == nil {
+			return ans, nil
+		}
+
+		var verr *types.ValidationException
+		var nerr *types.ResourceNotFoundException
+		if !errors.As(err, &verr) && !errors.As(err, &nerr) {
+			return nil, err
+		}
+	}
+
+	return b.retrieveAndGenerate(ctx, replayHistory(prompt), prompt.System, "")
+}
+
+// Render fills in the query, leaving the search results to the knowledge base.
+func (b *BedrockBackend) Render(prompt *Prompt) string {
+	query := prompt.Question
+	if prompt.SessionID == "" {
+		query = replayHistory(prompt)
+	}
+
+	return strings.ReplaceAll(promptTemplate(prompt.System), PlaceholderQuery, query)
+}
+
+func (b *BedrockBackend) retrieveAndGenerate(ctx context.Context, query string, system string, sessionId string) (*Answer, error) {
+	input := &bedrockagentruntime.RetrieveAndGenerateInput{
+		Input: &types.RetrieveAndGenerateInput{
+			Text: aws.String(query),
+		},
+		RetrieveAndGenerateConfiguration: &types.RetrieveAndGenerateConfiguration{
+			Type: types.RetrieveAndGenerateTypeKnowledgeBase,
+			KnowledgeBaseConfiguration: &types.KnowledgeBaseRetrieveAndGenerateConfiguration{
+				ModelArn:        aws.String(b.modelArn),
+				KnowledgeBaseId: aws.String(b.knowledgeBaseId),
+			},
+		},
+	}
+	if sessionId != "" {
+		input.SessionId = aws.String(sessionId)
+	}
+	if system != "" {
+		input.RetrieveAndGenerateConfiguration.KnowledgeBaseConfiguration.GenerationConfiguration = &types.GenerationConfiguration{
+			PromptTemplate: &types.PromptTemplate{
+				TextPromptTemplate: aws.String(promptTemplate(system)),
+			},
+		}
+	}
+
+	response, err := b.client.RetrieveAndGenerate(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve and generate: %w", err)
+	}
+
+	if response.Output == nil || response.Output.Text == nil {
+		return nil, ErrEmptyAnswer
+	}
+
+	return &Answer{
+		Text:      *response.Output.Text,
+		SessionID: aws.ToString(response.SessionId),
+	}, nil
+}
+
+// promptTemplate wraps the system prompt into a knowledge base template, unless
+// it already places the search results itself.
+func promptTemplate(system string) string {
+	if strings.Contains(system, PlaceholderSearchResults) {
+		return system
+	}
+
+	return system + "\n\n" +
+		"Search results:\n" + PlaceholderSearchResults + "\n\n" +
+		PlaceholderOutputFormat + "\n\n" +
+		"Question: " + PlaceholderQuery
+}
+
+// replayHistory folds the previous turns of a conversation into a single
+// query for backends without (or with an expired) session.
+func replayHistory(prompt *Prompt) string {
+	if len(prompt.History) == 0 {
+		return prompt.Question
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Previous conversation:\n")
+	for _, turn := range prompt.History {
+		sb.WriteString(turn.Role + ": " + turn.Content + "\n")
+	}
+	sb.WriteString("\nFollow-up question: " + prompt.Question)
+
+	return sb.String()
+}
@@ -1,14 +1,182 @@
 package qna
 
-import "github.com/bwmarrin/discordgo"
+import (
+	"errors"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var manageMessages int64 = discordgo.PermissionManageMessages
 
 var commands = []*discordgo.ApplicationCommand{
 	{
-		Name:        "qna-disable",
-		Description: "disables the Q&A module",
+		Name:        "ask",
+		Description: "ask Forkman a question",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "question",
+				Description: "to ask",
+				Required:    true,
+				MaxLength:   1000,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "public",
+				Description: "share the answer with the channel",
+				Required:    false,
+			},
+		},
+	},
+	{
+		Name: "Ask Forkman",
+		Type: discordgo.MessageApplicationCommand,
 	},
 	{
-		Name:        "qna-enable",
-		Description: "enables the Q&A module",
+		Name:        "faq",
+		Description: "post an answer from the FAQ",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "key",
+				Description:  "of the entry",
+				Required:     true,
+				Autocomplete: true,
+			},
+		},
 	},
+	{
+		Name:                     "qna",
+		Description:              "manage the Q&A module",
+		DefaultMemberPermissions: &manageMessages,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "queue",
+				Description: "list questions still waiting on a helper",
+			},
+		},
+	},
+}
+
+func (m *QNA) ask(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	question := ""
+	public := false
+	for _, opt := range i.ApplicationCommandData().Options {
+		switch opt.Name {
+		case "question":
+			question = opt.StringValue()
+		case "public":
+			public = opt.BoolValue()
+		}
+	}
+
+	m.answerInteraction(s, i, i.Member.User.ID, question, public)
+}
+
+func (m *QNA) askMessage(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	msg, ok := data.Resolved.Messages[data.TargetID]
+	if !ok || strings.TrimSpace(msg.Content) == "" {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "That message doesn't have any text for me to answer.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		return
+	}
+
+	m.answerInteraction(s, i, msg.Author.ID, msg.Content, true)
+}
+
+// answerInteraction defers the response (answers can take a while) and edits
+// it once the backend is done. The author is who wrote the question, which
+// is quoted as theirs, while the member asking is charged for it.
+func (m *QNA) answerInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, authorId string, question string, public bool) {
+	askerId := i.Member.User.ID
+
+	var flags discordgo.MessageFlags
+	if !public {
+		flags = discordgo.MessageFlagsEphemeral
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: flags,
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error deferring interaction response")
+		return
+	}
+
+	header := "<@" + authorId + "> asked:\n" + quoteQuestion(question)
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	prompt := &Prompt{Question: question}
+	text := ""
+
+	response, err := m.generate(cfg, askerId, prompt)
+	if err != nil {
+		m.log.Error().Err(err).Msg("failed to retrieve and generate")
+
+		// There's no thread to pull helpers into from here, so point the
+		// asker at the forum instead of promising they were told
+		var needsHelper bool
+		text, needsHelper = m.fallback(cfg, err)
+		if needsHelper {
+			forum := "please post it in <#" + m.forumChannelId + "> so our helpers can take a look!"
+			switch {
+			case errors.Is(err, ErrCircuitOpen):
+				text = "I'm having trouble reaching our knowledge base right now, " + forum
+			case errors.Is(err, ErrBudgetExhausted):
+				text = "I've answered all the questions I can for now, " + forum
+			default:
+				text = "That's a question best answered by a person, " + forum
+			}
+		}
+	} else {
+		text = response.Text
+		m.recordInteraction("", i.ChannelID, askerId, prompt.Question, response)
+	}
+
+	mentions := &discordgo.MessageAllowedMentions{
+		Users: []string{authorId},
+	}
+
+	parts, file := buildAnswer(header, text)
+	edit := &discordgo.WebhookEdit{
+		Content:         &parts[0],
+		AllowedMentions: mentions,
+	}
+	if file != nil {
+		edit.Files = []*discordgo.File{file}
+	}
+
+	_, err = s.InteractionResponseEdit(i.Interaction, edit)
+	if err != nil {
+		m.log.Error().Err(err).Msg("error editing interaction response")
+		return
+	}
+
+	for idx, part := range parts[1:] {
+		_, err = s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+			Content:         part,
+			AllowedMentions: mentions,
+			Flags:           flags,
+		})
+		if err != nil {
+			m.log.Error().Err(err).Int("part", idx+1).Msg("error sending answer part")
+			return
+		}
+	}
 }
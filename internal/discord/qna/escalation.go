@@ -0,0 +1,304 @@
+package qna
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/avvo-na/forkman/internal/discord/templates"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	EscalationOpen     = "open"
+	EscalationClaimed  = "claimed"
+	EscalationResolved = "resolved"
+)
+
+var CIDClaimEscalationBtn = "claim_escalation_button"
+
+func (m *QNA) handleCIDClaimEscalationBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if !isHelper(i.Member, cfg.HelperRoleID) {
+		templates.MessageEphemeral(s, i, "Only helpers can claim questions.")
+		return
+	}
+
+	esc, err := m.repo.ReadEscalationByMessage(i.Message.ID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading escalation from database")
+		templates.MessageEphemeral(s, i, "I couldn't find this escalation.")
+		return
+	}
+
+	if esc.Status != EscalationOpen {
+		templates.MessageEphemeral(s, i, "This question has already been claimed.")
+		return
+	}
+
+	// Two helpers can click at once, only one claim goes through
+	claimed, err := m.repo.ClaimEscalation(esc.ID, i.Member.User.ID, time.Now())
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error updating escalation in database")
+		return
+	}
+
+	if !claimed {
+		templates.MessageEphemeral(s, i, "This question has already been claimed.")
+		return
+	}
+
+	content := i.Message.Content + "\nClaimed by <@" + i.Member.User.ID + ">."
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: []discordgo.MessageComponent{},
+			AllowedMentions: &discordgo.MessageAllowedMentions{
+				Parse: []discordgo.AllowedMentionType{},
+			},
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error updating escalation message")
+		return
+	}
+
+	m.log.Info().
+		Uint("escalation_id", esc.ID).
+		Str("helper_id", i.Member.User.ID).
+		Msg("escalation claimed")
+}
+
+// escalate asks helpers to step into the channel the interaction came from,
+// unless they were already asked.
+func (m *QNA) escalate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	pending, err := m.repo.ReadUnresolvedChannelEscalations(i.ChannelID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading escalations from database")
+		return
+	}
+
+	if len(pending) > 0 {
+		templates.MessageEphemeral(s, i, "Helpers have already been notified, hang tight!")
+		return
+	}
+
+	err = m.openEscalation(i.ChannelID, i.Member.User.ID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error opening escalation")
+		templates.MessageEphemeral(s, i, "I couldn't reach our helpers, please try again later.")
+		return
+	}
+
+	templates.MessageEphemeral(s, i, "Helpers have been notified, hang tight!")
+}
+
+// openEscalation records a request for a helper and pings them in the channel
+// with a claim button.
+func (m *QNA) openEscalation(channelSnowflake string, requesterSnowflake string) error {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	esc, err := m.repo.CreateEscalation(&database.QNAEscalation{
+		GuildSnowflake:     m.guildSnowflake,
+		ChannelSnowflake:   channelSnowflake,
+		RequesterSnowflake: requesterSnowflake,
+		Status:             EscalationOpen,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create escalation: %w", err)
+	}
+
+	msg, err := m.session.ChannelMessageSendComplex(channelSnowflake, &discordgo.MessageSend{
+		Content: fmt.Sprintf("<@&%s> Assistance requested.", cfg.HelperRoleID),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label: " Claim",
+						Style: discordgo.PrimaryButton,
+						Emoji: &discordgo.ComponentEmoji{
+							Name: "🙋",
+						},
+						CustomID: CIDClaimEscalationBtn,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to send escalation message: %w", err)
+	}
+
+	// The claim button is looked up by message, so remember which one it is
+	esc.MessageSnowflake = msg.ID
+	_, err = m.repo.UpdateEscalation(esc)
+	if err != nil {
+		return fmt.Errorf("unable to update escalation: %w", err)
+	}
+
+	m.tagThread(channelSnowflake, []string{cfg.NeedsHelperTag}, []string{cfg.AnsweredTag})
+
+	m.log.Info().Uint("escalation_id", esc.ID).Msg("escalation opened")
+	return nil
+}
+
+// resolveEscalations marks every pending escalation of the channel as resolved.
+func (m *QNA) resolveEscalations(channelSnowflake string, helperSnowflake string) {
+	escs, err := m.repo.ReadUnresolvedChannelEscalations(channelSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading escalations from database")
+		return
+	}
+
+	now := time.Now()
+	for _, esc := range escs {
+		esc.Status = EscalationResolved
+		esc.ResolvedAt = &now
+		if esc.HelperSnowflake == "" {
+			esc.HelperSnowflake = helperSnowflake
+		}
+
+		_, err = m.repo.UpdateEscalation(&esc)
+		if err != nil {
+			m.log.Error().Err(err).Uint("escalation_id", esc.ID).Msg("critical error updating escalation in database")
+			continue
+		}
+
+		m.log.Info().Uint("escalation_id", esc.ID).Msg("escalation resolved")
+	}
+
+	if len(escs) == 0 {
+		return
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	m.tagThread(channelSnowflake, nil, []string{cfg.NeedsHelperTag})
+}
+
+// remindEscalations pings helpers again for questions nobody claimed. The
+// configured intervals are measured from when the escalation was opened.
+func (m *QNA) remindEscalations() {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	escs, err := m.repo.ReadUnresolvedEscalations(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading escalations from database")
+		return
+	}
+
+	now := time.Now()
+	for _, esc := range escs {
+		if esc.Status != EscalationOpen || esc.Reminders >= len(cfg.ReminderIntervals) {
+			continue
+		}
+
+		due := esc.CreatedAt.Add(time.Duration(cfg.ReminderIntervals[esc.Reminders]) * time.Minute)
+		if now.Before(due) {
+			continue
+		}
+
+		content := fmt.Sprintf("<@&%s> Reminder: this question has been waiting for %s.", cfg.HelperRoleID, formatAge(now.Sub(esc.CreatedAt)))
+		_, err = m.session.ChannelMessageSendComplex(esc.ChannelSnowflake, &discordgo.MessageSend{
+			Content: content,
+			Reference: &discordgo.MessageReference{
+				MessageID: esc.MessageSnowflake,
+				ChannelID: esc.ChannelSnowflake,
+			},
+		})
+		if err != nil {
+			m.log.Error().Err(err).Uint("escalation_id", esc.ID).Msg("error sending escalation reminder")
+			continue
+		}
+
+		esc.Reminders++
+		esc.RemindedAt = &now
+		_, err = m.repo.UpdateEscalation(&esc)
+		if err != nil {
+			m.log.Error().Err(err).Uint("escalation_id", esc.ID).Msg("critical error updating escalation in database")
+		}
+	}
+}
+
+// UnresolvedEscalations lists the escalations still waiting on a helper,
+// oldest first.
+func (m *QNA) UnresolvedEscalations() ([]database.QNAEscalation, error) {
+	return m.repo.ReadUnresolvedEscalations(m.guildSnowflake)
+}
+
+func (m *QNA) queue(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if !isHelper(i.Member, cfg.HelperRoleID) {
+		templates.MessageEphemeral(s, i, "Only helpers can see the queue.")
+		return
+	}
+
+	escs, err := m.repo.ReadUnresolvedEscalations(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading escalations from database")
+		templates.MessageEphemeral(s, i, "I couldn't read the queue, please try again later.")
+		return
+	}
+
+	if len(escs) == 0 {
+		templates.MessageEphemeral(s, i, "The queue is empty, nice work! 🎉")
+		return
+	}
+
+	lines := []string{}
+	for _, esc := range escs {
+		line := fmt.Sprintf("<#%s> • **%s** • %s", esc.ChannelSnowflake, esc.Status, formatAge(time.Since(esc.CreatedAt)))
+		if esc.HelperSnowflake != "" {
+			line += " • <@" + esc.HelperSnowflake + ">"
+		}
+		lines = append(lines, line)
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       fmt.Sprintf("Open Escalations (%d)", len(escs)),
+					Description: strings.Join(lines, "\n"),
+					Color:       colors.ASUMaroon,
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+// formatAge renders a duration rounded to the minute, ie. "2h5m".
+func formatAge(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "<1m"
+	}
+
+	return strings.TrimSuffix(d.String(), "0s")
+}
@@ -0,0 +1,260 @@
+package qna
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/avvo-na/forkman/internal/discord/templates"
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+const (
+	maxChoices     = 25  // Discord limit per autocomplete response
+	maxChoiceName  = 100 // Discord limit per choice name
+	maxEmbedLength = 4096
+)
+
+var (
+	ErrFaqNotFound = errors.New("faq entry not found")
+	ErrFaqConflict = errors.New("faq key or alias already in use")
+)
+
+// Faq lists the FAQ entries of the guild, ordered by key.
+func (m *QNA) Faq() ([]database.FaqEntry, error) {
+	return m.repo.ReadFaqEntries(m.guildSnowflake)
+}
+
+// ReadFaq looks an entry up by key or alias.
+func (m *QNA) ReadFaq(key string) (*database.FaqEntry, error) {
+	entries, err := m.repo.ReadFaqEntries(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	key = normalizeFaqKey(key)
+	for _, entry := range entries {
+		if entry.Key == key || slices.Contains(entry.Aliases, key) {
+			return &entry, nil
+		}
+	}
+
+	return nil, ErrFaqNotFound
+}
+
+func (m *QNA) CreateFaq(entry *database.FaqEntry) (*database.FaqEntry, error) {
+	entry.ID = 0
+	entry.GuildSnowflake = m.guildSnowflake
+	normalizeFaq(entry)
+
+	err := m.checkFaqConflict(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.repo.CreateFaqEntry(entry)
+}
+
+// UpdateFaq replaces the entry stored under key, which may be renamed.
+func (m *QNA) UpdateFaq(key string, entry *database.FaqEntry) (*database.FaqEntry, error) {
+	existing, err := m.repo.ReadFaqEntry(m.guildSnowflake, normalizeFaqKey(key))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrFaqNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry.ID = existing.ID
+	entry.GuildSnowflake = m.guildSnowflake
+	normalizeFaq(entry)
+
+	err = m.checkFaqConflict(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.repo.UpdateFaqEntry(entry)
+}
+
+func (m *QNA) DeleteFaq(key string) error {
+	err := m.repo.DeleteFaqEntry(m.guildSnowflake, normalizeFaqKey(key))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrFaqNotFound
+	}
+
+	return err
+}
+
+// checkFaqConflict makes sure no other entry uses any of the entry's names.
+func (m *QNA) checkFaqConflict(entry *database.FaqEntry) error {
+	entries, err := m.repo.ReadFaqEntries(m.guildSnowflake)
+	if err != nil {
+		return err
+	}
+
+	names := append([]string{entry.Key}, entry.Aliases...)
+	for _, other := range entries {
+		if other.ID == entry.ID {
+			continue
+		}
+
+		for _, name := range names {
+			if other.Key == name || slices.Contains(other.Aliases, name) {
+				return fmt.Errorf("%w: %s", ErrFaqConflict, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchFaq finds the entry best matching a question, if FAQ answers are
+// enabled and one scores above the threshold.
+func (m *QNA) matchFaq(cfg *QNAConfig, question string) *database.FaqEntry {
+	if !cfg.FaqFirst {
+		return nil
+	}
+
+	entries, err := m.repo.ReadFaqEntries(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading faq entries from database")
+		return nil
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	docs := make([]string, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry.Title + " " + strings.Join(append([]string{entry.Key}, entry.Aliases...), " ")
+	}
+
+	best := -1
+	bestScore := cfg.FaqThreshold
+	for i, score := range rankSimilar(question, docs) {
+		if score >= bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	m.log.Info().Str("faq_key", entries[best].Key).Float64("score", bestScore).Msg("question answered from faq")
+	return &entries[best]
+}
+
+func (m *QNA) faq(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	key := i.ApplicationCommandData().Options[0].StringValue()
+
+	entry, err := m.ReadFaq(key)
+	if errors.Is(err, ErrFaqNotFound) {
+		templates.MessageEphemeral(s, i, fmt.Sprintf("There's no FAQ entry called `%s`.", key))
+		return
+	}
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading faq entries from database")
+		templates.MessageEphemeral(s, i, "I couldn't read the FAQ, please try again later.")
+		return
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{faqEmbed(entry)},
+		},
+	})
+}
+
+// faqAutocomplete suggests entries whose key, alias or title contains what
+// has been typed so far.
+func (m *QNA) faqAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	typed := ""
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Focused {
+			typed = strings.ToLower(opt.StringValue())
+		}
+	}
+
+	entries, err := m.repo.ReadFaqEntries(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading faq entries from database")
+	}
+
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, entry := range entries {
+		if len(choices) == maxChoices {
+			break
+		}
+
+		names := append([]string{entry.Key, strings.ToLower(entry.Title)}, entry.Aliases...)
+		if !slices.ContainsFunc(names, func(n string) bool { return strings.Contains(n, typed) }) {
+			continue
+		}
+
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  truncate(entry.Key+" - "+entry.Title, maxChoiceName),
+			Value: entry.Key,
+		})
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error responding to autocomplete")
+	}
+}
+
+func faqEmbed(entry *database.FaqEntry) *discordgo.MessageEmbed {
+	return &discordgo.MessageEmbed{
+		Title:       entry.Title,
+		Description: truncate(entry.Body, maxEmbedLength),
+		Color:       colors.ASUMaroon,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: "FAQ: " + entry.Key,
+		},
+	}
+}
+
+// faqAnswer formats an entry as an answer to a question.
+func faqAnswer(entry *database.FaqEntry) *Answer {
+	return &Answer{Text: "**" + entry.Title + "**\n\n" + entry.Body}
+}
+
+func normalizeFaq(entry *database.FaqEntry) {
+	entry.Key = normalizeFaqKey(entry.Key)
+
+	aliases := []string{}
+	for _, alias := range entry.Aliases {
+		alias = normalizeFaqKey(alias)
+		if alias != "" && alias != entry.Key && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	entry.Aliases = aliases
+}
+
+func normalizeFaqKey(key string) string {
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+func truncate(text string, limit int) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+
+	return string([]rune(text)[:limit-1]) + "…"
+}
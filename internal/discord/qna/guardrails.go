@@ -0,0 +1,142 @@
+package qna
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	BlockedActionRefuse = "refuse" // Decline to answer
+	BlockedActionDefer  = "defer"  // Hand the question over to helpers
+)
+
+type RedactPattern struct {
+	Name        string `json:"name" validate:"required"`
+	Pattern     string `json:"pattern" validate:"required"`
+	Replacement string `json:"replacement"`
+}
+
+var (
+	ErrBlockedTopic = errors.New("question touches a blocked topic")
+
+	mentionEveryone = regexp.MustCompile(`@(everyone|here)`)
+	mentionRole     = regexp.MustCompile(`<@&\d+>`)
+)
+
+var defaultRedactPatterns = []RedactPattern{
+	{Name: "email", Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, Replacement: "[email]"},
+	{Name: "asu_id", Pattern: `\b\d{10}\b`, Replacement: "[asu id]"},
+	{Name: "phone", Pattern: `(\+?1[\s.-]?)?\(?\b\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}\b`, Replacement: "[phone]"},
+}
+
+// Validate checks what the struct tags can't, ie. that patterns compile.
+func (c *QNAConfig) Validate() error {
+	for _, p := range c.RedactPatterns {
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("invalid redact pattern %s: %w", p.Name, err)
+		}
+	}
+
+	// A full template must leave room for the knowledge base results
+	if strings.Contains(c.SystemPrompt, PlaceholderQuery) && !strings.Contains(c.SystemPrompt, PlaceholderSearchResults) {
+		return fmt.Errorf("system prompt uses %s without %s", PlaceholderQuery, PlaceholderSearchResults)
+	}
+
+	return nil
+}
+
+// guardInput runs a question through the input pipeline: redaction, blocked
+// topics and the length cap. Every stage is logged so redactions can be
+// audited without logging the content itself.
+func (m *QNA) guardInput(cfg *QNAConfig, text string) (string, error) {
+	text = m.redact(cfg, text)
+
+	lower := strings.ToLower(text)
+	for _, topic := range cfg.BlockedTopics {
+		if topic != "" && strings.Contains(lower, strings.ToLower(topic)) {
+			m.log.Info().
+				Str("stage", "blocked_topic").
+				Str("topic", topic).
+				Str("action", cfg.BlockedAction).
+				Msg("question blocked")
+			return "", fmt.Errorf("%w: %s", ErrBlockedTopic, topic)
+		}
+	}
+
+	if length := utf8.RuneCountInString(text); length > cfg.MaxInputLength {
+		text = string([]rune(text)[:cfg.MaxInputLength])
+		m.log.Info().
+			Str("stage", "truncate").
+			Int("length", length).
+			Int("max_length", cfg.MaxInputLength).
+			Msg("question truncated")
+	}
+
+	return text, nil
+}
+
+// redact replaces everything matching the configured PII patterns.
+func (m *QNA) redact(cfg *QNAConfig, text string) string {
+	for _, p := range cfg.RedactPatterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			m.log.Error().Err(err).Str("pattern", p.Name).Msg("invalid redact pattern, skipping")
+			continue
+		}
+
+		count := len(re.FindAllStringIndex(text, -1))
+		if count == 0 {
+			continue
+		}
+
+		text = re.ReplaceAllLiteralString(text, p.Replacement)
+		m.log.Info().
+			Str("stage", "redact").
+			Str("pattern", p.Name).
+			Int("count", count).
+			Msg("question redacted")
+	}
+
+	return text
+}
+
+// guardOutput makes sure model output can't mass ping the guild.
+func (m *QNA) guardOutput(text string) string {
+	everyone := len(mentionEveryone.FindAllStringIndex(text, -1))
+	roles := len(mentionRole.FindAllStringIndex(text, -1))
+	if everyone == 0 && roles == 0 {
+		return text
+	}
+
+	text = mentionEveryone.ReplaceAllString(text, "$1")
+	text = mentionRole.ReplaceAllLiteralString(text, "")
+	m.log.Info().
+		Str("stage", "sanitize_output").
+		Int("everyone_mentions", everyone).
+		Int("role_mentions", roles).
+		Msg("answer sanitized")
+
+	return text
+}
+
+// fallback turns a failed generation into a reply for the asker, and reports
+// whether helpers should be pulled into the conversation.
+func (m *QNA) fallback(cfg *QNAConfig, err error) (string, bool) {
+	switch {
+	case errors.Is(err, ErrBlockedTopic) && cfg.BlockedAction == BlockedActionDefer:
+		return "That's a question best answered by a person, I've let our helpers know!", true
+	case errors.Is(err, ErrBlockedTopic):
+		return "Sorry, that's not something I can help with.", false
+	case errors.Is(err, ErrCircuitOpen):
+		return "I'm having trouble reaching our knowledge base right now, our helpers have been notified!", true
+	case errors.Is(err, ErrBusy):
+		return "I'm answering a lot of questions right now, please try again in a few minutes.", false
+	case errors.Is(err, ErrBudgetExhausted):
+		return "I've answered all the questions I can for now, I've let our helpers know!", true
+	default:
+		return "Uh oh, I couldn't find an answer to your question. Please try again later.", false
+	}
+}
@@ -1,21 +1,25 @@
 package qna
 
 import (
-	"context"
 	"fmt"
+	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
-	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/avvo-na/forkman/internal/discord/templates"
 	"github.com/bwmarrin/discordgo"
 )
 
 var (
 	CIDAdditionalAssistanceBtn = "additional_assistance_button"
 	CIDSatisfactoryAnswerBtn   = "satisfactory_answer_button"
+	CIDAskFollowUpBtn          = "ask_follow_up_button"
+	CIDAskFollowUpModal        = "ask_follow_up_modal"
 	HelperRoleID               = "1213199035968528434"
 )
 
+const answerSeparator = "\n----------------------\n"
+
 func (m *QNA) handleQNARequest(s *discordgo.Session, msg *discordgo.MessageCreate) {
 	channel, err := m.session.Channel(msg.ChannelID)
 	if err != nil {
@@ -27,41 +31,327 @@ func (m *QNA) handleQNARequest(s *discordgo.Session, msg *discordgo.MessageCreat
 		return
 	}
 
+	if channel.ParentID != m.forumChannelId {
+		return
+	}
+
 	if channel.MessageCount != 0 {
+		m.handleFollowUp(s, msg, channel)
 		return
 	}
 
-	if channel.ParentID != m.forumChannelId {
+	thread, err := m.repo.CreateThread(&database.QNAThread{
+		GuildSnowflake:   m.guildSnowflake,
+		ChannelSnowflake: channel.ID,
+		AskerSnowflake:   msg.Author.ID,
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error creating thread in database")
 		return
 	}
 
-	userId := msg.Author.ID
-	channelID := msg.ChannelID
-	content := "Hi <@" + userId + ">, I'm Forkman, your friendly support bot. I'm looking through our knowledge base to see if I can answer your question. :wave:"
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
 
-	message, _ := s.ChannelMessageSend(msg.ChannelID, content)
-	query := channel.Name + " " + msg.Content
+	question := channel.Name + " " + msg.Content
 
-	input := &bedrockagentruntime.RetrieveAndGenerateInput{
-		Input: &types.RetrieveAndGenerateInput{
-			Text: aws.String(query),
-		},
-		RetrieveAndGenerateConfiguration: &types.RetrieveAndGenerateConfiguration{
-			Type: types.RetrieveAndGenerateTypeKnowledgeBase,
-			KnowledgeBaseConfiguration: &types.KnowledgeBaseRetrieveAndGenerateConfiguration{
-				ModelArn:        aws.String("us.anthropic.claude-3-5-sonnet-20241022-v2:0"),
-				KnowledgeBaseId: aws.String(m.knowledgeBaseId),
+	// Point to earlier threads first, a strong enough match with an accepted
+	// answer saves us a model call altogether
+	similar := m.findSimilar(channel.ID, question, cfg.SimilarThreshold, cfg.MaxSimilar)
+	if len(similar) > 0 {
+		m.sendSimilar(s, channel.ID, similar)
+
+		// Blocked questions go on to answer, which gives the blocked reply
+		best := similar[0]
+		guarded, err := m.guardInput(cfg, question)
+		if err == nil && cfg.ReuseAcceptedAnswers && best.Answer != "" && best.Score >= cfg.ReuseThreshold {
+			intro := greeting(cfg, msg.Author.ID) + "\nThis looks a lot like a question we've answered before!"
+			message, err := s.ChannelMessageSend(channel.ID, intro)
+			if err != nil {
+				m.log.Error().Err(err).Msg("error sending message")
+				return
+			}
+
+			m.log.Debug().
+				Str("similar_channel_id", best.ChannelSnowflake).
+				Float64("score", best.Score).
+				Msg("answering from a similar thread")
+			m.deliver(s, thread, message, intro, guarded, &Answer{
+				Text: best.Answer + "\n\n*Originally answered in <#" + best.ChannelSnowflake + ">.*",
+			})
+			return
+		}
+	}
+
+	m.answer(s, thread, greeting(cfg, msg.Author.ID), question, nil)
+}
+
+// sendSimilar links the earlier threads resembling the question.
+func (m *QNA) sendSimilar(s *discordgo.Session, channelId string, similar []Similar) {
+	lines := []string{}
+	for _, sim := range similar {
+		lines = append(lines, fmt.Sprintf("• <#%s> (%.0f%% match)", sim.ChannelSnowflake, sim.Score*100))
+	}
+
+	_, err := s.ChannelMessageSendEmbed(channelId, &discordgo.MessageEmbed{
+		Title:       "Similar questions",
+		Description: "These earlier posts might already have your answer:\n" + strings.Join(lines, "\n"),
+		Color:       colors.ASUMaroon,
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error sending similar questions")
+	}
+}
+
+// handleFollowUp continues the conversation when the asker mentions the bot
+// inside a thread we already answered, until a helper steps in.
+func (m *QNA) handleFollowUp(s *discordgo.Session, msg *discordgo.MessageCreate, channel *discordgo.Channel) {
+	thread, err := m.repo.ReadThread(channel.ID)
+	if err != nil {
+		return
+	}
+
+	if msg.Author.ID != thread.AskerSnowflake {
+		cfg, err := m.ReadConfig()
+		if err != nil {
+			m.log.Error().Err(err).Msg("critical error reading config")
+			return
+		}
+
+		if isHelper(msg.Member, cfg.HelperRoleID) {
+			m.onHelperReply(thread, msg.Author.ID)
+		}
+		return
+	}
+
+	if thread.Closed {
+		return
+	}
+
+	if !mentionsUser(msg.Message, s.State.User.ID) {
+		return
+	}
+
+	question := strings.NewReplacer(
+		"<@"+s.State.User.ID+">", "",
+		"<@!"+s.State.User.ID+">", "",
+	).Replace(msg.Content)
+	question = strings.TrimSpace(question)
+	if question == "" {
+		return
+	}
+
+	if ok := m.checkTurnLimit(thread); !ok {
+		s.ChannelMessageSendReply(channel.ID, "I've answered as much as I can in this thread, a helper will take it from here!", msg.Reference())
+		return
+	}
+
+	greeting := "Good question <@" + msg.Author.ID + ">, let me look into that follow-up. :mag:"
+	m.answer(s, thread, greeting, question, m.threadHistory(thread, msg.ID))
+}
+
+// onHelperReply hands the thread over to the helper: the bot stops answering
+// and any pending escalation is resolved.
+func (m *QNA) onHelperReply(thread *database.QNAThread, helperSnowflake string) {
+	m.resolveEscalations(thread.ChannelSnowflake, helperSnowflake)
+
+	if thread.Closed {
+		return
+	}
+
+	thread.Closed = true
+	_, err := m.repo.UpdateThread(thread)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error closing thread in database")
+		return
+	}
+
+	m.log.Debug().Str("channel_id", thread.ChannelSnowflake).Msg("helper replied, thread closed")
+}
+
+func (m *QNA) handleCIDAskFollowUpBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	thread, err := m.repo.ReadThread(i.ChannelID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading thread from database")
+		templates.MessageEphemeral(s, i, "I couldn't find this conversation, please create a new post.")
+		return
+	}
+
+	if ok := m.canFollowUp(s, i, thread); !ok {
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: CIDAskFollowUpModal,
+			Title:    "Ask a follow-up",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							Label:     "What else would you like to know?",
+							CustomID:  "follow_up_input_field",
+							Style:     discordgo.TextInputParagraph,
+							Required:  true,
+							MaxLength: 1000,
+						},
+					},
+				},
 			},
 		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error sending modal to user")
+		return
+	}
+}
+
+func (m *QNA) handleCIDAskFollowUpModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	question := i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+
+	thread, err := m.repo.ReadThread(i.ChannelID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading thread from database")
+		templates.MessageEphemeral(s, i, "I couldn't find this conversation, please create a new post.")
+		return
+	}
+
+	// The thread may have changed while the modal was open
+	if ok := m.canFollowUp(s, i, thread); !ok {
+		return
 	}
 
-	response, err := m.bedrock.RetrieveAndGenerate(context.Background(), input)
-	if err != nil || response.Output == nil {
+	// Echo the question so the rest of the thread can follow along
+	templates.Message(s, i, "**Follow-up from <@"+i.Member.User.ID+">:** "+question)
+
+	greeting := "Good question <@" + i.Member.User.ID + ">, let me look into that follow-up. :mag:"
+	m.answer(s, thread, greeting, question, m.threadHistory(thread, ""))
+}
+
+// canFollowUp tells the member why they can't ask a follow-up, if they can't.
+func (m *QNA) canFollowUp(s *discordgo.Session, i *discordgo.InteractionCreate, thread *database.QNAThread) bool {
+	if i.Member.User.ID != thread.AskerSnowflake {
+		templates.MessageEphemeral(s, i, "Only the original poster can ask follow-up questions.")
+		return false
+	}
+
+	if thread.Closed {
+		templates.MessageEphemeral(s, i, "A helper has joined this thread, they will take it from here!")
+		return false
+	}
+
+	if ok := m.checkTurnLimit(thread); !ok {
+		templates.MessageEphemeral(s, i, "I've answered as much as I can in this thread, a helper will take it from here!")
+		return false
+	}
+
+	return true
+}
+
+// generate is the single entry point to the backend for every QnA surface.
+// The prompt is redacted in place before it leaves the bot, and the answer
+// sanitized before it reaches Discord.
+func (m *QNA) generate(cfg *QNAConfig, userSnowflake string, prompt *Prompt) (*Answer, error) {
+	question, err := m.guardInput(cfg, prompt.Question)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt.Question = question
+
+	// Curated answers are free and preferred over the model
+	if entry := m.matchFaq(cfg, question); entry != nil {
+		return faqAnswer(entry), nil
+	}
+
+	err = m.checkBudget(cfg, userSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt.System = systemPrompt(cfg)
+	for i := range prompt.History {
+		prompt.History[i].Content = m.redact(cfg, prompt.History[i].Content)
+	}
+
+	response, err := m.callBackend(cfg, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Text = m.guardOutput(response.Text)
+	estimateUsage(prompt, response)
+	return response, nil
+}
+
+// answer posts a placeholder message in the thread, asks the backend and
+// delivers the result in place of the placeholder.
+func (m *QNA) answer(s *discordgo.Session, thread *database.QNAThread, greeting string, question string, history []Turn) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	message, err := s.ChannelMessageSend(thread.ChannelSnowflake, greeting)
+	if err != nil {
+		m.log.Error().Err(err).Msg("error sending message")
+		return
+	}
+
+	prompt := &Prompt{
+		Question:  question,
+		SessionID: thread.SessionID,
+		History:   history,
+	}
+
+	response, err := m.generate(cfg, thread.AskerSnowflake, prompt)
+	if err != nil {
 		m.log.Error().Err(err).Msg("failed to retrieve and generate")
-		s.ChannelMessageEdit(channelID, message.ID, "Uh oh, I couldn't find an answer to your question. Please try again later.")
+
+		text, needsHelper := m.fallback(cfg, err)
+		s.ChannelMessageEdit(thread.ChannelSnowflake, message.ID, text)
+		if needsHelper {
+			if err := m.openEscalation(thread.ChannelSnowflake, thread.AskerSnowflake); err != nil {
+				m.log.Error().Err(err).Msg("critical error opening escalation")
+			}
+		}
 		return
 	}
 
+	m.deliver(s, thread, message, greeting, prompt.Question, response)
+}
+
+// deliver edits the placeholder message with the answer and the feedback
+// buttons, and updates the thread state.
+func (m *QNA) deliver(s *discordgo.Session, thread *database.QNAThread, message *discordgo.Message, greeting string, question string, response *Answer) {
+	channelID := thread.ChannelSnowflake
+	userId := thread.AskerSnowflake
+	content := greeting
+
+	// Reused and FAQ answers have no session, keep the backend's one going
+	if response.SessionID != "" {
+		thread.SessionID = response.SessionID
+	}
+	thread.Turns++
+	_, err := m.repo.UpdateThread(thread)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error updating thread in database")
+	}
+
+	m.recordInteraction(m.forumChannelId, channelID, userId, question, response)
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+	} else {
+		m.tagThread(channelID, []string{cfg.AnsweredTag}, nil)
+	}
+
 	embed := &discordgo.MessageEmbed{
 		Description: "<@" + userId + ">, we're still improving our answers! Please rate the quality of the answer below.",
 		Color:       0x00FF00, // green color
@@ -85,36 +375,63 @@ func (m *QNA) handleQNARequest(s *discordgo.Session, msg *discordgo.MessageCreat
 				},
 				CustomID: CIDAdditionalAssistanceBtn,
 			},
+			discordgo.Button{
+				Label: " Ask follow-up",
+				Style: discordgo.SecondaryButton,
+				Emoji: &discordgo.ComponentEmoji{
+					Name: "💬",
+				},
+				CustomID: CIDAskFollowUpBtn,
+			},
 		},
 	}
 
-	content = content + "\n----------------------\n" + *response.Output.Text
+	// The placeholder becomes the first part, the rest are sent as replies to
+	// it and the rating buttons always go on the last part
+	parts, file := buildAnswer(content, response.Text)
+	last := len(parts) - 1
 
-	_, err = s.ChannelMessageEditComplex(
-		&discordgo.MessageEdit{
-			Content:    &content,
-			Channel:    channelID,
-			ID:         message.ID,
-			Embed:      embed,
-			Components: &[]discordgo.MessageComponent{buttonRow},
-		},
-	)
+	edit := &discordgo.MessageEdit{
+		Content: &parts[0],
+		Channel: channelID,
+		ID:      message.ID,
+	}
+	if file != nil {
+		edit.Files = []*discordgo.File{file}
+	}
+	if last == 0 {
+		edit.Embed = embed
+		edit.Components = &[]discordgo.MessageComponent{buttonRow}
+	}
+
+	_, err = s.ChannelMessageEditComplex(edit)
 	if err != nil {
 		m.log.Error().Err(err).Msg("error editing message")
 		return
 	}
+
+	for idx, part := range parts[1:] {
+		send := &discordgo.MessageSend{
+			Content:   part,
+			Reference: message.Reference(),
+		}
+		if idx+1 == last {
+			send.Embed = embed
+			send.Components = []discordgo.MessageComponent{buttonRow}
+		}
+
+		_, err = s.ChannelMessageSendComplex(channelID, send)
+		if err != nil {
+			m.log.Error().Err(err).Int("part", idx+1).Msg("error sending answer part")
+			return
+		}
+	}
 }
 
 func (m *QNA) handleCIDAdditionalAssistanceBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	ping := fmt.Sprintf("<@&%s> Assistance requested.", HelperRoleID)
 	content := i.Message.Content
 
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{
-			Content: ping,
-		},
-	})
+	m.escalate(s, i)
 
 	_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
 		Content:    &content,
@@ -132,6 +449,24 @@ func (m *QNA) handleCIDAdditionalAssistanceBtn(s *discordgo.Session, i *discordg
 func (m *QNA) handleCIDSatisfactoryAnswerBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	content := i.Message.Content
 
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	thread, err := m.repo.ReadThread(i.ChannelID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading thread from database")
+		templates.MessageEphemeral(s, i, "I couldn't find this conversation, please create a new post.")
+		return
+	}
+
+	if i.Member.User.ID != thread.AskerSnowflake && !isHelper(i.Member, cfg.HelperRoleID) {
+		templates.MessageEphemeral(s, i, "Only the original poster or a helper can mark this as solved.")
+		return
+	}
+
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
@@ -140,7 +475,7 @@ func (m *QNA) handleCIDSatisfactoryAnswerBtn(s *discordgo.Session, i *discordgo.
 		},
 	})
 
-	_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+	_, err = s.ChannelMessageEditComplex(&discordgo.MessageEdit{
 		Content:    &content,
 		Channel:    i.ChannelID,
 		ID:         i.Message.ID,
@@ -151,4 +486,12 @@ func (m *QNA) handleCIDSatisfactoryAnswerBtn(s *discordgo.Session, i *discordgo.
 		m.log.Error().Err(err).Msg("error editing message")
 		return
 	}
+
+	err = m.repo.AcceptLatestInteraction(i.ChannelID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error accepting interaction in database")
+	}
+
+	m.markSolved(i.ChannelID)
+	m.tagThread(i.ChannelID, []string{cfg.SolvedTag}, []string{cfg.NeedsHelperTag})
 }
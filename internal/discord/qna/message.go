@@ -0,0 +1,187 @@
+package qna
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	messageLimit        = 2000 // Discord's hard limit per message
+	previewLimit        = 1500 // Shown inline when the full answer is attached
+	attachmentThreshold = 6000 // Past this we attach the answer instead of splitting
+	codeFence           = "```"
+	attachmentName      = "answer.md"
+	attachmentNotice    = "\n\n*This answer is too long for Discord, the full answer is attached.*"
+	quoteLimit          = 500  // Of a question quoted in a header
+	headerLimit         = 1000 // Leaves at least half of the first message to the answer
+)
+
+// block is either a paragraph or a fenced code block of an answer.
+type block struct {
+	text  string
+	fence string // Opening fence line (ie. "```go"), empty for paragraphs
+}
+
+// buildAnswer renders a header and the model output into Discord sized
+// messages. The first part always starts with the header and the separator.
+// Very long answers are truncated to a preview and returned in full as a
+// markdown attachment instead.
+func buildAnswer(header string, text string) ([]string, *discordgo.File) {
+	prefix := truncate(header, headerLimit) + answerSeparator
+	room := messageLimit - utf8.RuneCountInString(prefix)
+
+	if utf8.RuneCountInString(text) > attachmentThreshold {
+		limit := min(previewLimit, room-utf8.RuneCountInString(attachmentNotice))
+		preview := splitMessage(text, limit)[0]
+		file := &discordgo.File{
+			Name:        attachmentName,
+			ContentType: "text/markdown",
+			Reader:      strings.NewReader(text),
+		}
+		return []string{prefix + preview + attachmentNotice}, file
+	}
+
+	parts := splitMessage(text, room)
+	parts[0] = prefix + parts[0]
+
+	return parts, nil
+}
+
+// quoteQuestion renders a question as a markdown quote, cut short so it
+// can't crowd the answer out of a header.
+func quoteQuestion(question string) string {
+	return truncate("> "+strings.ReplaceAll(truncate(question, quoteLimit), "\n", "\n> "), quoteLimit*2)
+}
+
+// splitMessage splits text into chunks of at most limit characters, breaking
+// on paragraph and code block boundaries where possible. Code blocks split
+// across chunks are closed and reopened so every chunk renders on its own.
+func splitMessage(text string, limit int) []string {
+	chunks := []string{}
+	var cur strings.Builder
+
+	flush := func() {
+		if cur.Len() > 0 {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, b := range parseBlocks(text) {
+		for _, piece := range b.pieces(limit) {
+			size := utf8.RuneCountInString(cur.String())
+			if size > 0 && size+2+utf8.RuneCountInString(piece) > limit {
+				flush()
+			}
+
+			if cur.Len() > 0 {
+				cur.WriteString("\n\n")
+			}
+			cur.WriteString(piece)
+		}
+	}
+	flush()
+
+	if len(chunks) == 0 {
+		chunks = append(chunks, "")
+	}
+
+	return chunks
+}
+
+// parseBlocks breaks markdown into paragraphs and fenced code blocks. An
+// unterminated code block runs until the end of the text.
+func parseBlocks(text string) []block {
+	blocks := []block{}
+	lines := []string{}
+	fence := ""
+
+	push := func() {
+		if len(lines) > 0 || fence != "" {
+			blocks = append(blocks, block{text: strings.Join(lines, "\n"), fence: fence})
+		}
+		lines = lines[:0]
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case fence == "" && strings.HasPrefix(trimmed, codeFence):
+			push()
+			fence = trimmed
+		case fence != "" && trimmed == codeFence:
+			push()
+			fence = ""
+		case fence == "" && trimmed == "":
+			push()
+		default:
+			lines = append(lines, line)
+		}
+	}
+	push()
+
+	return blocks
+}
+
+// pieces renders the block into strings of at most limit characters.
+func (b block) pieces(limit int) []string {
+	if b.fence == "" {
+		return splitLines(b.text, limit)
+	}
+
+	// Leave room for the opening and closing fences
+	overhead := utf8.RuneCountInString(b.fence) + len("\n\n") + len(codeFence)
+	ret := []string{}
+	for _, body := range splitLines(b.text, max(limit-overhead, 1)) {
+		ret = append(ret, b.fence+"\n"+body+"\n"+codeFence)
+	}
+
+	return ret
+}
+
+// splitLines packs whole lines into chunks of at most limit characters, hard
+// splitting any single line that is longer than that.
+func splitLines(text string, limit int) []string {
+	if utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+
+	ret := []string{}
+	var cur strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		for _, part := range splitRunes(line, limit) {
+			size := utf8.RuneCountInString(cur.String())
+			if size > 0 && size+1+utf8.RuneCountInString(part) > limit {
+				ret = append(ret, cur.String())
+				cur.Reset()
+			}
+
+			if cur.Len() > 0 {
+				cur.WriteString("\n")
+			}
+			cur.WriteString(part)
+		}
+	}
+	ret = append(ret, cur.String())
+
+	return ret
+}
+
+func splitRunes(s string, limit int) []string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return []string{s}
+	}
+
+	ret := []string{}
+	for len(runes) > limit {
+		ret = append(ret, string(runes[:limit]))
+		runes = runes[limit:]
+	}
+	ret = append(ret, string(runes))
+
+	return ret
+}
@@ -0,0 +1,189 @@
+package qna
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// content strips fence lines and whitespace, which splitting adds and
+// removes, leaving what a reader would see.
+func content(text string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+			continue
+		}
+		b.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+
+	return b.String()
+}
+
+// checkParts fails unless every part fits the limit, is valid UTF-8 and has
+// its code fences balanced.
+func checkParts(t *testing.T, parts []string, limit int) {
+	t.Helper()
+
+	for i, part := range parts {
+		if n := utf8.RuneCountInString(part); n > limit {
+			t.Errorf("part %d: got %d characters, want at most %d", i, n, limit)
+		}
+		if !utf8.ValidString(part) {
+			t.Errorf("part %d: split inside a rune", i)
+		}
+
+		fences := 0
+		for _, line := range strings.Split(part, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+				fences++
+			}
+		}
+		if fences%2 != 0 {
+			t.Errorf("part %d: unbalanced code fences:\n%s", i, part)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	code := strings.Repeat("fmt.Println(\"hello, world\")\n", 200)
+
+	tests := []struct {
+		name      string
+		text      string
+		limit     int
+		wantParts int
+	}{
+		{name: "empty", text: "", limit: messageLimit, wantParts: 1},
+		{name: "short", text: "Office hours are on Tuesdays.", limit: messageLimit, wantParts: 1},
+		{name: "exactly the limit", text: strings.Repeat("a", messageLimit), limit: messageLimit, wantParts: 1},
+		{name: "one over the limit", text: strings.Repeat("a", messageLimit+1), limit: messageLimit, wantParts: 2},
+		{name: "paragraphs", text: strings.Repeat(strings.Repeat("word ", 100)+"\n\n", 10), limit: messageLimit},
+		{name: "long code fence", text: "Try this:\n\n```go\n" + code + "```\n\nThat should work.", limit: messageLimit},
+		{name: "unterminated code fence", text: "```python\n" + strings.Repeat("print('hi')\n", 400), limit: messageLimit},
+		{name: "code line longer than the limit", text: "```\n" + strings.Repeat("x", 5000) + "\n```", limit: messageLimit},
+		{name: "multi-byte runes", text: strings.Repeat("😀", 4500), limit: messageLimit, wantParts: 3},
+		{name: "multi-byte code", text: "```\n" + strings.Repeat("ñandú ☕ 日本語\n", 300) + "```", limit: messageLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitMessage(tt.text, tt.limit)
+			checkParts(t, parts, tt.limit)
+
+			if tt.wantParts != 0 && len(parts) != tt.wantParts {
+				t.Errorf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+
+			if got := content(strings.Join(parts, "\n")); got != content(tt.text) {
+				t.Errorf("content changed by splitting")
+			}
+		})
+	}
+}
+
+func TestBlockPieces(t *testing.T) {
+	tests := []struct {
+		name  string
+		block block
+		limit int
+	}{
+		{name: "paragraph", block: block{text: strings.Repeat("word ", 1000)}, limit: messageLimit},
+		{name: "code", block: block{text: strings.Repeat("let x = 1;\n", 500), fence: "```rust"}, limit: messageLimit},
+		{name: "long fence language", block: block{text: strings.Repeat("y\n", 1000), fence: codeFence + strings.Repeat("z", 100)}, limit: messageLimit},
+		{name: "multi-byte code", block: block{text: strings.Repeat("日本語のコード\n", 500), fence: codeFence}, limit: messageLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pieces := tt.block.pieces(tt.limit)
+			checkParts(t, pieces, tt.limit)
+
+			for i, piece := range pieces {
+				if tt.block.fence != "" && (!strings.HasPrefix(piece, tt.block.fence+"\n") || !strings.HasSuffix(piece, "\n"+codeFence)) {
+					t.Errorf("piece %d isn't wrapped in the block's fences", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitRunes(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		limit     int
+		wantParts int
+	}{
+		{name: "ascii under the limit", text: "hello", limit: 10, wantParts: 1},
+		{name: "ascii over the limit", text: strings.Repeat("a", 25), limit: 10, wantParts: 3},
+		{name: "runes at the limit", text: strings.Repeat("é", 10), limit: 10, wantParts: 1},
+		{name: "runes over the limit", text: strings.Repeat("🔱", 21), limit: 10, wantParts: 3},
+		{name: "mixed widths", text: strings.Repeat("aé日😀", 500), limit: messageLimit, wantParts: 1},
+		{name: "mixed widths over the limit", text: strings.Repeat("aé日😀", 501), limit: messageLimit, wantParts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitRunes(tt.text, tt.limit)
+			checkParts(t, parts, tt.limit)
+
+			if len(parts) != tt.wantParts {
+				t.Errorf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+			if strings.Join(parts, "") != tt.text {
+				t.Error("parts don't join back into the text")
+			}
+		})
+	}
+}
+
+func TestBuildAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		text     string
+		wantFile bool
+	}{
+		{name: "short", header: "**Answer**", text: "Yes."},
+		{name: "split", header: "**Answer**", text: strings.Repeat("A sentence of the answer.\n\n", 200)},
+		{name: "long header", header: strings.Repeat("h", 3000), text: strings.Repeat("word ", 500)},
+		{name: "long quoted question", header: quoteQuestion(strings.Repeat("why does this crash?\n", 200)), text: "```go\n" + strings.Repeat("panic(err)\n", 150) + "```"},
+		{name: "multi-byte header", header: strings.Repeat("❓", 1500), text: strings.Repeat("答え", 900)},
+		{name: "attached", header: "**Answer**", text: strings.Repeat("x", attachmentThreshold+1), wantFile: true},
+		{name: "attached with a long header", header: strings.Repeat("h", 3000), text: "```\n" + strings.Repeat("🙂\n", attachmentThreshold) + "```", wantFile: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, file := buildAnswer(tt.header, tt.text)
+			checkParts(t, parts, messageLimit)
+
+			prefix := truncate(tt.header, headerLimit) + answerSeparator
+			if !strings.HasPrefix(parts[0], prefix) {
+				t.Error("first part doesn't start with the header")
+			}
+
+			if (file != nil) != tt.wantFile {
+				t.Fatalf("got file %v, want one %t", file != nil, tt.wantFile)
+			}
+
+			if file == nil {
+				if got := content(strings.TrimPrefix(strings.Join(parts, "\n"), prefix)); got != content(tt.text) {
+					t.Error("answer changed by splitting")
+				}
+				return
+			}
+
+			if len(parts) != 1 || !strings.HasSuffix(parts[0], attachmentNotice) {
+				t.Errorf("got %d parts, want a single preview with the notice", len(parts))
+			}
+
+			full, _ := io.ReadAll(file.Reader)
+			if string(full) != tt.text {
+				t.Error("attachment isn't the full answer")
+			}
+		})
+	}
+}
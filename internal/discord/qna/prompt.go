@@ -0,0 +1,84 @@
+package qna
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Bedrock knowledge base placeholders, search results are mandatory
+	PlaceholderQuery         = "$query$"
+	PlaceholderSearchResults = "$search_results$"
+	PlaceholderOutputFormat  = "$output_format_instructions$"
+
+	defaultSystemPrompt = "You are Forkman, a friendly support bot for a Discord community. " +
+		"Answer the user's question using only the search results below."
+	defaultGreeting = "Hi {user}, I'm Forkman, your friendly support bot. " +
+		"I'm looking through our knowledge base to see if I can answer your question. :wave:"
+)
+
+// systemPrompt renders the answer style of the guild into instructions for
+// the model. A system prompt containing the search results placeholder is
+// taken as a complete template and only gets the style lines appended. It's
+// empty for guilds without any style, which keep the knowledge base's own
+// prompt.
+func systemPrompt(cfg *QNAConfig) string {
+	if strings.TrimSpace(cfg.SystemPrompt) == "" && cfg.Language == "" && cfg.Tone == "" &&
+		cfg.MaxAnswerWords == 0 && cfg.UnknownAnswer == "" {
+		return ""
+	}
+
+	lines := []string{}
+
+	base := strings.TrimSpace(cfg.SystemPrompt)
+	if base == "" {
+		base = defaultSystemPrompt
+	}
+	lines = append(lines, base)
+
+	if cfg.Language != "" {
+		lines = append(lines, fmt.Sprintf("Always answer in %s.", cfg.Language))
+	}
+	if cfg.Tone != "" {
+		lines = append(lines, fmt.Sprintf("Use a %s tone.", cfg.Tone))
+	}
+	if cfg.MaxAnswerWords != 0 {
+		lines = append(lines, fmt.Sprintf("Keep your answer under %d words.", cfg.MaxAnswerWords))
+	}
+	if cfg.UnknownAnswer != "" {
+		lines = append(lines, fmt.Sprintf("If the search results don't answer the question, reply exactly: %q", cfg.UnknownAnswer))
+	} else {
+		lines = append(lines, "If the search results don't answer the question, say you don't know rather than guessing.")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// greeting renders the first message posted in a new QnA thread.
+func greeting(cfg *QNAConfig, userSnowflake string) string {
+	text := cfg.Greeting
+	if text == "" {
+		text = defaultGreeting
+	}
+
+	return strings.ReplaceAll(text, "{user}", "<@"+userSnowflake+">")
+}
+
+// PreviewPrompt renders the prompt the backend would receive for a question,
+// without calling it.
+func (m *QNA) PreviewPrompt(cfg *QNAConfig, question string) (string, error) {
+	question, err := m.guardInput(cfg, question)
+	if err != nil {
+		return "", err
+	}
+
+	return m.backend.Render(&Prompt{
+		Question: question,
+		System:   systemPrompt(cfg),
+	}), nil
+}
+
+// PreviewGreeting renders the thread greeting for a placeholder user.
+func (m *QNA) PreviewGreeting(cfg *QNAConfig) string {
+	return strings.ReplaceAll(greeting(cfg, "user"), "<@user>", "@user")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/avvo-na/forkman/internal/database"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
@@ -12,18 +13,71 @@ import (
 	"gorm.io/gorm"
 )
 
-type QNAConfig struct{}
+type QNAConfig struct {
+	// Conversation
+	MaxTurns int `json:"max_turns" validate:"gte=1"` // Answers per thread, including the first
+
+	// Escalation
+	HelperRoleID      string `json:"helper_role_id" validate:"required"`
+	ReminderIntervals []int  `json:"reminder_intervals_minutes" validate:"dive,gte=1"` // Since the escalation was opened
+
+	// Forum tags & thread state, tags are matched by name
+	AnsweredTag    string `json:"answered_tag"`
+	NeedsHelperTag string `json:"needs_helper_tag"`
+	SolvedTag      string `json:"solved_tag"`
+	AutoCloseHours int    `json:"auto_close_hours" validate:"gte=0"` // Idle time before solved threads close, 0 disables
+	AutoCloseLock  bool   `json:"auto_close_lock"`                   // Lock threads as well as archiving them
+
+	// Duplicate detection, scores are a 0-1 similarity
+	MaxSimilar           int     `json:"max_similar" validate:"gte=0"` // Similar threads linked, 0 disables
+	SimilarThreshold     float64 `json:"similar_threshold" validate:"gte=0,lte=1"`
+	ReuseAcceptedAnswers bool    `json:"reuse_accepted_answers"` // Answer from an accepted answer instead of the model
+	ReuseThreshold       float64 `json:"reuse_threshold" validate:"gte=0,lte=1"`
+
+	// Guardrails, applied before anything is sent to the backend
+	RedactPatterns []RedactPattern `json:"redact_patterns" validate:"dive"`
+	BlockedTopics  []string        `json:"blocked_topics"` // Case-insensitive phrases
+	BlockedAction  string          `json:"blocked_action" validate:"oneof=refuse defer"`
+	MaxInputLength int             `json:"max_input_length" validate:"gte=1"` // Characters
+
+	// Token budgets, 0 means unlimited
+	GuildDailyTokens   int `json:"guild_daily_tokens" validate:"gte=0"`
+	GuildMonthlyTokens int `json:"guild_monthly_tokens" validate:"gte=0"`
+	UserDailyTokens    int `json:"user_daily_tokens" validate:"gte=0"`
+	UserMonthlyTokens  int `json:"user_monthly_tokens" validate:"gte=0"`
+
+	// Backend resilience
+	TimeoutSeconds         int `json:"timeout_seconds" validate:"gte=1"` // Per attempt
+	MaxRetries             int `json:"max_retries" validate:"gte=0"`     // On throttling and transient errors
+	MaxConcurrent          int `json:"max_concurrent" validate:"gte=1"`  // Calls in flight for the guild
+	QueueTimeoutSeconds    int `json:"queue_timeout_seconds" validate:"gte=1"`
+	BreakerThreshold       int `json:"breaker_threshold" validate:"gte=1"` // Consecutive failures
+	BreakerCooldownMinutes int `json:"breaker_cooldown_minutes" validate:"gte=1"`
+
+	// FAQ, scores are a 0-1 similarity
+	FaqFirst     bool    `json:"faq_first"` // Answer from a matching FAQ entry instead of the model
+	FaqThreshold float64 `json:"faq_threshold" validate:"gte=0,lte=1"`
+
+	// Answer style, empty values fall back to the built-in prompt
+	SystemPrompt   string `json:"system_prompt" validate:"max=4000"` // May place $search_results$ and $query$ itself
+	Language       string `json:"language" validate:"max=50"`
+	Tone           string `json:"tone" validate:"max=50"`
+	MaxAnswerWords int    `json:"max_answer_words" validate:"gte=0"` // Hint only, 0 disables
+	UnknownAnswer  string `json:"unknown_answer" validate:"max=500"` // Said when the knowledge base has no answer
+	Greeting       string `json:"greeting" validate:"max=1000"`      // {user} mentions the asker
+}
 
 type QNA struct {
-	guildName       string
-	guildSnowflake  string
-	appId           string
-	session         *discordgo.Session
-	bedrock         *bedrockagentruntime.Client
-	forumChannelId  string
-	knowledgeBaseId string
-	repo            *Repository
-	log             *zerolog.Logger
+	guildName      string
+	guildSnowflake string
+	appId          string
+	session        *discordgo.Session
+	backend        Backend
+	breaker        *breaker
+	pool           *pool
+	forumChannelId string
+	repo           *Repository
+	log            *zerolog.Logger
 }
 
 const (
@@ -55,15 +109,16 @@ func New(
 		Logger()
 
 	return &QNA{
-		guildName:       guildName,
-		guildSnowflake:  guildSnowflake,
-		appId:           appId,
-		session:         session,
-		bedrock:         bedrock,
-		forumChannelId:  forumChannelId,
-		knowledgeBaseId: knowledgeBaseId,
-		repo:            NewRepository(db),
-		log:             &l,
+		guildName:      guildName,
+		guildSnowflake: guildSnowflake,
+		appId:          appId,
+		session:        session,
+		backend:        NewBedrockBackend(bedrock, knowledgeBaseId),
+		breaker:        &breaker{},
+		pool:           &pool{},
+		forumChannelId: forumChannelId,
+		repo:           NewRepository(db),
+		log:            &l,
 	}
 }
 
@@ -72,8 +127,8 @@ func (m *QNA) Load() error {
 	if err == gorm.ErrRecordNotFound {
 		m.log.Debug().Msg("module not found, creating...")
 
-		// Default general config (empty)
-		cfgJson, _ := json.Marshal(QNAConfig{})
+		// Default general config
+		cfgJson, _ := json.Marshal(defaultConfig())
 
 		// Default command config (all enabled)
 		cmdMap := make(map[string]bool)
@@ -255,6 +310,52 @@ func (m *QNA) Status() (bool, error) {
 	return true, nil
 }
 
+// Sweep runs the periodic upkeep of the module.
+func (m *QNA) Sweep() {
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil || !mod.Enabled {
+		return
+	}
+
+	m.remindEscalations()
+	m.closeSolvedThreads()
+}
+
+func (m *QNA) ReadConfig() (*QNAConfig, error) {
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the defaults so fields missing from older configs are filled in
+	cfg := defaultConfig()
+	err = json.Unmarshal([]byte(mod.Config), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("critical error unmarshalling config json: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (m *QNA) UpdateConfig(cfg *QNAConfig) error {
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil {
+		return err
+	}
+
+	mod.Config, err = json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("critical error marshalling config json: %w", err)
+	}
+
+	_, err = m.repo.UpdateModule(mod)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (m *QNA) OnInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	mod, err := m.repo.ReadModule(i.GuildID)
 	if err != nil {
@@ -268,8 +369,12 @@ func (m *QNA) OnInteractionCreate(s *discordgo.Session, i *discordgo.Interaction
 	switch i.Type {
 	case discordgo.InteractionApplicationCommand:
 		m.handleCommand(s, i)
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		m.handleAutocomplete(s, i)
 	case discordgo.InteractionMessageComponent:
 		m.handleComponent(s, i)
+	case discordgo.InteractionModalSubmit:
+		m.handleModal(s, i)
 	}
 }
 
@@ -282,9 +387,9 @@ func (m *QNA) OnMessageCreate(s *discordgo.Session, msg *discordgo.MessageCreate
 		return
 	}
 
-  if msg.GuildID == "" {
-    return
-  }
+	if msg.GuildID == "" {
+		return
+	}
 
 	mod, err := m.repo.ReadModule(msg.GuildID)
 	if err != nil {
@@ -298,15 +403,45 @@ func (m *QNA) OnMessageCreate(s *discordgo.Session, msg *discordgo.MessageCreate
 	m.handleQNARequest(s, msg)
 }
 
-func (m *QNA) handleCommand(_ *discordgo.Session, i *discordgo.InteractionCreate) {
+func (m *QNA) handleCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	name := i.ApplicationCommandData().Name
 
 	switch name {
+	case "ask":
+		m.ask(s, i)
+	case "Ask Forkman":
+		m.askMessage(s, i)
+	case "faq":
+		m.faq(s, i)
+	case "qna":
+		m.handleSubcommand(s, i)
 	default:
 		m.log.Info().Msg("command not found")
 	}
 }
 
+func (m *QNA) handleAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	name := i.ApplicationCommandData().Name
+
+	switch name {
+	case "faq":
+		m.faqAutocomplete(s, i)
+	default:
+		m.log.Info().Msg("autocomplete not found")
+	}
+}
+
+func (m *QNA) handleSubcommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	name := i.ApplicationCommandData().Options[0].Name
+
+	switch name {
+	case "queue":
+		m.queue(s, i)
+	default:
+		m.log.Info().Msg("subcommand not found")
+	}
+}
+
 func (m *QNA) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	cid := i.MessageComponentData().CustomID
 
@@ -315,9 +450,53 @@ func (m *QNA) handleComponent(s *discordgo.Session, i *discordgo.InteractionCrea
 		m.handleCIDAdditionalAssistanceBtn(s, i)
 	case CIDSatisfactoryAnswerBtn:
 		m.handleCIDSatisfactoryAnswerBtn(s, i)
+	case CIDAskFollowUpBtn:
+		m.handleCIDAskFollowUpBtn(s, i)
+	case CIDClaimEscalationBtn:
+		m.handleCIDClaimEscalationBtn(s, i)
+	default:
+		m.log.Error().
+			Str("custom_id", cid).
+			Msg("unhandled interaction")
+	}
+}
+
+func (m *QNA) handleModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cid := i.ModalSubmitData().CustomID
+
+	switch cid {
+	case CIDAskFollowUpModal:
+		m.handleCIDAskFollowUpModal(s, i)
 	default:
 		m.log.Error().
 			Str("custom_id", cid).
 			Msg("unhandled interaction")
 	}
 }
+
+func defaultConfig() *QNAConfig {
+	return &QNAConfig{
+		MaxTurns:               5,
+		HelperRoleID:           HelperRoleID,
+		ReminderIntervals:      []int{30, 120, 480},
+		AnsweredTag:            "AI answered",
+		NeedsHelperTag:         "Needs helper",
+		SolvedTag:              "Solved",
+		AutoCloseHours:         24,
+		AutoCloseLock:          true,
+		MaxSimilar:             3,
+		SimilarThreshold:       0.5,
+		ReuseThreshold:         0.85,
+		RedactPatterns:         slices.Clone(defaultRedactPatterns),
+		BlockedAction:          BlockedActionRefuse,
+		MaxInputLength:         1000,
+		TimeoutSeconds:         30,
+		MaxRetries:             2,
+		MaxConcurrent:          3,
+		QueueTimeoutSeconds:    60,
+		BreakerThreshold:       5,
+		BreakerCooldownMinutes: 5,
+		FaqThreshold:           0.6,
+		Greeting:               defaultGreeting,
+	}
+}
@@ -0,0 +1,200 @@
+package qna
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+const (
+	backoffBase = time.Second
+	backoffMax  = 20 * time.Second
+)
+
+var (
+	ErrCircuitOpen = errors.New("backend circuit breaker is open")
+	ErrBusy        = errors.New("too many questions queued")
+)
+
+// breaker stops calling the backend after too many consecutive failures and
+// lets a single trial call through once the cooldown has passed.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+// record reports whether the call opened the breaker.
+func (b *breaker) record(err error, threshold int, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.trial = false
+		return false
+	}
+
+	b.failures++
+	if b.trial || b.failures >= threshold {
+		wasClosed := b.openUntil.IsZero()
+		b.openUntil = time.Now().Add(cooldown)
+		b.trial = false
+		return wasClosed
+	}
+
+	return false
+}
+
+// pool caps the backend calls in flight, queueing the rest in arrival order.
+// The limit is passed on every call so config changes apply immediately.
+type pool struct {
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+func (p *pool) acquire(ctx context.Context, limit int) error {
+	p.mu.Lock()
+	if p.active < limit && len(p.waiters) == 0 {
+		p.active++
+		p.mu.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	p.waiters = append(p.waiters, ch)
+	p.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		for i, w := range p.waiters {
+			if w == ch {
+				p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+				return ErrBusy
+			}
+		}
+
+		// We were handed a slot while timing out, give it back
+		p.releaseLocked(limit)
+		return ErrBusy
+	}
+}
+
+func (p *pool) release(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.releaseLocked(limit)
+}
+
+func (p *pool) releaseLocked(limit int) {
+	p.active--
+	for len(p.waiters) > 0 && p.active < limit {
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+		p.active++
+	}
+}
+
+// callBackend runs a generation through the worker pool and circuit breaker,
+// with a timeout on every attempt and backoff between throttled ones.
+func (m *QNA) callBackend(cfg *QNAConfig, prompt *Prompt) (*Answer, error) {
+	// Queue before asking the breaker, a trial call let through must always
+	// reach record or the breaker would stay open
+	queueCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.QueueTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	err := m.pool.acquire(queueCtx, cfg.MaxConcurrent)
+	if err != nil {
+		m.log.Warn().Int("max_concurrent", cfg.MaxConcurrent).Msg("backend queue timed out")
+		return nil, err
+	}
+	defer m.pool.release(cfg.MaxConcurrent)
+
+	if !m.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	var response *Answer
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.TimeoutSeconds)*time.Second)
+		response, err = m.backend.Generate(ctx, prompt)
+		cancel()
+
+		if err == nil || !retryable(err) || attempt >= cfg.MaxRetries {
+			break
+		}
+
+		delay := backoff(attempt)
+		m.log.Warn().Err(err).Int("attempt", attempt+1).Dur("delay", delay).Msg("backend call failed, retrying")
+		time.Sleep(delay)
+	}
+
+	// Empty answers aren't an outage, don't count them against the backend
+	if errors.Is(err, ErrEmptyAnswer) {
+		m.breaker.record(nil, cfg.BreakerThreshold, 0)
+		return nil, err
+	}
+
+	cooldown := time.Duration(cfg.BreakerCooldownMinutes) * time.Minute
+	if m.breaker.record(err, cfg.BreakerThreshold, cooldown) {
+		m.log.Error().Err(err).Dur("cooldown", cooldown).Msg("backend circuit breaker opened")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backend call failed: %w", err)
+	}
+
+	return response, nil
+}
+
+// retryable reports whether an error is worth another attempt: throttling,
+// transient service errors and timeouts.
+func retryable(err error) bool {
+	var terr *types.ThrottlingException
+	var ierr *types.InternalServerException
+	var derr *types.DependencyFailedException
+
+	return errors.As(err, &terr) ||
+		errors.As(err, &ierr) ||
+		errors.As(err, &derr) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// backoff is exponential with full jitter.
+func backoff(attempt int) time.Duration {
+	d := backoffBase << attempt
+	if d > backoffMax || d <= 0 {
+		d = backoffMax
+	}
+
+	return time.Duration(rand.Int64N(int64(d))) + backoffBase/2
+}
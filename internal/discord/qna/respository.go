@@ -1,6 +1,8 @@
 package qna
 
 import (
+	"time"
+
 	"github.com/avvo-na/forkman/internal/database"
 	"gorm.io/gorm"
 )
@@ -52,3 +54,271 @@ func (r *Repository) UpdateModule(mod *database.Module) (*database.Module, error
 
 	return nil, nil
 }
+
+func (r *Repository) CreateThread(thread *database.QNAThread) (*database.QNAThread, error) {
+	result := r.db.Create(thread)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return thread, nil
+}
+
+func (r *Repository) ReadThread(channelSnowflake string) (*database.QNAThread, error) {
+	t := &database.QNAThread{}
+	result := r.db.First(t, "channel_snowflake = ?", channelSnowflake)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return t, nil
+}
+
+func (r *Repository) ReadSolvedThreads(guildSnowflake string) ([]database.QNAThread, error) {
+	threads := []database.QNAThread{}
+	result := r.db.
+		Where("guild_snowflake = ? AND solved_at IS NOT NULL AND archived = ?", guildSnowflake, false).
+		Find(&threads)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return threads, nil
+}
+
+func (r *Repository) UpdateThread(thread *database.QNAThread) (*database.QNAThread, error) {
+	t := &database.QNAThread{}
+	result := r.db.First(t, "channel_snowflake = ?", thread.ChannelSnowflake)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	t.SessionID = thread.SessionID
+	t.Turns = thread.Turns
+	t.Closed = thread.Closed
+	t.Archived = thread.Archived
+	t.SolvedAt = thread.SolvedAt
+
+	err := r.db.Save(t).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (r *Repository) CreateEscalation(esc *database.QNAEscalation) (*database.QNAEscalation, error) {
+	result := r.db.Create(esc)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return esc, nil
+}
+
+func (r *Repository) ReadEscalationByMessage(messageSnowflake string) (*database.QNAEscalation, error) {
+	esc := &database.QNAEscalation{}
+	result := r.db.First(esc, "message_snowflake = ?", messageSnowflake)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return esc, nil
+}
+
+func (r *Repository) ReadUnresolvedEscalations(guildSnowflake string) ([]database.QNAEscalation, error) {
+	escs := []database.QNAEscalation{}
+	result := r.db.
+		Where("guild_snowflake = ? AND status <> ?", guildSnowflake, EscalationResolved).
+		Order("created_at").
+		Find(&escs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return escs, nil
+}
+
+func (r *Repository) ReadUnresolvedChannelEscalations(channelSnowflake string) ([]database.QNAEscalation, error) {
+	escs := []database.QNAEscalation{}
+	result := r.db.
+		Where("channel_snowflake = ? AND status <> ?", channelSnowflake, EscalationResolved).
+		Find(&escs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return escs, nil
+}
+
+// ClaimEscalation hands an open escalation to a helper, reporting false when
+// another helper got there first.
+func (r *Repository) ClaimEscalation(id uint, helperSnowflake string, claimedAt time.Time) (bool, error) {
+	result := r.db.Model(&database.QNAEscalation{}).
+		Where("id = ? AND status = ?", id, EscalationOpen).
+		Updates(map[string]interface{}{
+			"status":           EscalationClaimed,
+			"helper_snowflake": helperSnowflake,
+			"claimed_at":       claimedAt,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) UpdateEscalation(esc *database.QNAEscalation) (*database.QNAEscalation, error) {
+	e := &database.QNAEscalation{}
+	result := r.db.First(e, "id = ?", esc.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	e.MessageSnowflake = esc.MessageSnowflake
+	e.HelperSnowflake = esc.HelperSnowflake
+	e.Status = esc.Status
+	e.Reminders = esc.Reminders
+	e.RemindedAt = esc.RemindedAt
+	e.ClaimedAt = esc.ClaimedAt
+	e.ResolvedAt = esc.ResolvedAt
+
+	err := r.db.Save(e).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (r *Repository) CreateInteraction(interaction *database.QNAInteraction) (*database.QNAInteraction, error) {
+	result := r.db.Create(interaction)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return interaction, nil
+}
+
+// ReadForumInteractions returns the most recent interactions of a forum,
+// newest first, leaving out the given thread.
+func (r *Repository) ReadForumInteractions(forumSnowflake string, excludeChannel string, limit int) ([]database.QNAInteraction, error) {
+	interactions := []database.QNAInteraction{}
+	result := r.db.
+		Where("forum_snowflake = ? AND channel_snowflake <> ?", forumSnowflake, excludeChannel).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&interactions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return interactions, nil
+}
+
+// AcceptLatestInteraction marks the last answer given in a channel as accepted.
+func (r *Repository) AcceptLatestInteraction(channelSnowflake string) error {
+	i := &database.QNAInteraction{}
+	result := r.db.Order("created_at DESC").First(i, "channel_snowflake = ?", channelSnowflake)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	i.Accepted = true
+	return r.db.Save(i).Error
+}
+
+// SumTokens adds up the tokens used in a guild since the given time, limited to
+// one user unless userSnowflake is empty.
+func (r *Repository) SumTokens(guildSnowflake string, userSnowflake string, since time.Time) (int, error) {
+	var total int
+	query := r.db.Model(&database.QNAInteraction{}).
+		Select("COALESCE(SUM(input_tokens + output_tokens), 0)").
+		Where("guild_snowflake = ? AND created_at >= ?", guildSnowflake, since)
+	if userSnowflake != "" {
+		query = query.Where("user_snowflake = ?", userSnowflake)
+	}
+
+	result := query.Scan(&total)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return total, nil
+}
+
+func (r *Repository) ReadInteractionsBetween(guildSnowflake string, from time.Time, to time.Time) ([]database.QNAInteraction, error) {
+	interactions := []database.QNAInteraction{}
+	result := r.db.
+		Select("created_at", "input_tokens", "output_tokens", "estimated").
+		Where("guild_snowflake = ? AND created_at >= ? AND created_at < ?", guildSnowflake, from, to).
+		Order("created_at").
+		Find(&interactions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return interactions, nil
+}
+
+func (r *Repository) CreateFaqEntry(entry *database.FaqEntry) (*database.FaqEntry, error) {
+	result := r.db.Create(entry)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entry, nil
+}
+
+func (r *Repository) ReadFaqEntries(guildSnowflake string) ([]database.FaqEntry, error) {
+	entries := []database.FaqEntry{}
+	result := r.db.Where("guild_snowflake = ?", guildSnowflake).Order("key").Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entries, nil
+}
+
+func (r *Repository) ReadFaqEntry(guildSnowflake string, key string) (*database.FaqEntry, error) {
+	entry := &database.FaqEntry{}
+	result := r.db.First(entry, "guild_snowflake = ? AND key = ?", guildSnowflake, key)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entry, nil
+}
+
+func (r *Repository) UpdateFaqEntry(entry *database.FaqEntry) (*database.FaqEntry, error) {
+	e := &database.FaqEntry{}
+	result := r.db.First(e, "id = ?", entry.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	e.Key = entry.Key
+	e.Title = entry.Title
+	e.Body = entry.Body
+	e.Aliases = entry.Aliases
+
+	err := r.db.Save(e).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (r *Repository) DeleteFaqEntry(guildSnowflake string, key string) error {
+	result := r.db.Where("guild_snowflake = ? AND key = ?", guildSnowflake, key).Delete(&database.FaqEntry{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
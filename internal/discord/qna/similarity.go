@@ -0,0 +1,171 @@
+package qna
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/avvo-na/forkman/internal/database"
+)
+
+const candidateLimit = 500 // Most recent interactions searched for duplicates
+
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true,
+	"you": true, "all": true, "can": true, "her": true, "was": true, "one": true,
+	"our": true, "out": true, "has": true, "have": true, "how": true, "what": true,
+	"when": true, "where": true, "who": true, "why": true, "does": true, "this": true,
+	"that": true, "with": true, "from": true, "they": true, "will": true, "would": true,
+	"there": true, "their": true, "about": true, "which": true, "into": true, "your": true,
+	"been": true, "any": true, "just": true, "get": true, "its": true, "also": true,
+	"should": true, "could": true, "need": true, "know": true, "anyone": true, "thanks": true,
+}
+
+// Similar is a prior thread resembling a new question.
+type Similar struct {
+	ChannelSnowflake string
+	Question         string
+	Answer           string // Accepted answer of the thread, if any
+	Score            float64
+}
+
+// findSimilar ranks the previous threads of the forum against a question and
+// returns those scoring at least threshold, best first.
+func (m *QNA) findSimilar(channelSnowflake string, question string, threshold float64, limit int) []Similar {
+	if limit == 0 {
+		return nil
+	}
+
+	interactions, err := m.repo.ReadForumInteractions(m.forumChannelId, channelSnowflake, candidateLimit)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading interactions from database")
+		return nil
+	}
+
+	// One candidate per thread: its original question and accepted answer
+	threads := []*Similar{}
+	byChannel := make(map[string]*Similar)
+	for _, interaction := range interactions {
+		c, ok := byChannel[interaction.ChannelSnowflake]
+		if !ok {
+			c = &Similar{ChannelSnowflake: interaction.ChannelSnowflake}
+			byChannel[interaction.ChannelSnowflake] = c
+			threads = append(threads, c)
+		}
+
+		// Interactions are newest first, so the last one seen is the original post
+		c.Question = interaction.Question
+		if interaction.Accepted && c.Answer == "" {
+			c.Answer = interaction.Answer
+		}
+	}
+
+	docs := make([]string, len(threads))
+	for i, c := range threads {
+		docs[i] = c.Question
+	}
+
+	ret := []Similar{}
+	for i, score := range rankSimilar(question, docs) {
+		if score < threshold {
+			continue
+		}
+		threads[i].Score = score
+		ret = append(ret, *threads[i])
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Score > ret[j].Score })
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+
+	return ret
+}
+
+// recordInteraction stores a question and its answer for duplicate detection
+// and usage reporting.
+func (m *QNA) recordInteraction(forumSnowflake string, channelSnowflake string, userSnowflake string, question string, answer *Answer) {
+	_, err := m.repo.CreateInteraction(&database.QNAInteraction{
+		GuildSnowflake:   m.guildSnowflake,
+		ForumSnowflake:   forumSnowflake,
+		ChannelSnowflake: channelSnowflake,
+		UserSnowflake:    userSnowflake,
+		Question:         question,
+		Answer:           answer.Text,
+		InputTokens:      answer.InputTokens,
+		OutputTokens:     answer.OutputTokens,
+		Estimated:        answer.Estimated,
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error creating interaction in database")
+	}
+}
+
+// rankSimilar scores every document against the query with a TF-IDF weighted
+// cosine similarity between 0 and 1.
+func rankSimilar(query string, docs []string) []float64 {
+	tfs := make([]map[string]float64, len(docs))
+	df := make(map[string]int)
+	for i, doc := range docs {
+		tfs[i] = termFrequencies(doc)
+		for term := range tfs[i] {
+			df[term]++
+		}
+	}
+
+	n := float64(len(docs) + 1)
+	idf := func(term string) float64 {
+		return math.Log(n/float64(df[term]+1)) + 1
+	}
+
+	q := weigh(termFrequencies(query), idf)
+	scores := make([]float64, len(docs))
+	for i := range docs {
+		scores[i] = cosine(q, weigh(tfs[i], idf))
+	}
+
+	return scores
+}
+
+func termFrequencies(text string) map[string]float64 {
+	tf := make(map[string]float64)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for _, word := range words {
+		if len(word) < 3 || stopWords[word] {
+			continue
+		}
+		tf[word]++
+	}
+
+	return tf
+}
+
+func weigh(tf map[string]float64, idf func(string) float64) map[string]float64 {
+	ret := make(map[string]float64, len(tf))
+	for term, freq := range tf {
+		ret[term] = freq * idf(term)
+	}
+
+	return ret
+}
+
+func cosine(a map[string]float64, b map[string]float64) float64 {
+	var dot, na, nb float64
+	for term, w := range a {
+		dot += w * b[term]
+		na += w * w
+	}
+	for _, w := range b {
+		nb += w * w
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,223 @@
+package qna
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const maxAppliedTags = 5 // Discord limit per forum post
+
+// tagThread adds and removes forum tags by name on a QnA thread. Names the
+// forum doesn't have are ignored so guilds can opt out of any tag.
+func (m *QNA) tagThread(channelId string, add []string, remove []string) {
+	thread, err := m.session.Channel(channelId)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error getting thread channel")
+		return
+	}
+
+	if thread.ParentID != m.forumChannelId {
+		return
+	}
+
+	forum, err := m.session.Channel(thread.ParentID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error getting forum channel")
+		return
+	}
+
+	tags := slices.Clone(thread.AppliedTags)
+	for _, name := range remove {
+		id := forumTagID(forum, name)
+		tags = slices.DeleteFunc(tags, func(t string) bool { return t == id })
+	}
+	for _, name := range add {
+		id := forumTagID(forum, name)
+		if id == "" || slices.Contains(tags, id) || len(tags) >= maxAppliedTags {
+			continue
+		}
+		tags = append(tags, id)
+	}
+
+	if slices.Equal(tags, thread.AppliedTags) {
+		return
+	}
+
+	_, err = m.session.ChannelEditComplex(channelId, &discordgo.ChannelEdit{
+		AppliedTags: &tags,
+	})
+	if err != nil {
+		m.log.Error().Err(err).Str("channel_id", channelId).Msg("error updating thread tags")
+		return
+	}
+}
+
+// markSolved starts the idle countdown after which a solved thread is closed.
+func (m *QNA) markSolved(channelId string) {
+	thread, err := m.repo.ReadThread(channelId)
+	if err != nil || thread.SolvedAt != nil {
+		return
+	}
+
+	now := time.Now()
+	thread.SolvedAt = &now
+	_, err = m.repo.UpdateThread(thread)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error updating thread in database")
+	}
+}
+
+// OnThreadUpdate keeps the thread state in sync with the forum: a solved tag
+// resolves escalations and marks the thread solved, removing it reopens it.
+func (m *QNA) OnThreadUpdate(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	if t.Channel == nil || t.ParentID != m.forumChannelId {
+		return
+	}
+
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil || !mod.Enabled {
+		return
+	}
+
+	thread, err := m.repo.ReadThread(t.ID)
+	if err != nil {
+		return
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	forum, err := s.Channel(t.ParentID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error getting forum channel")
+		return
+	}
+
+	solvedTag := forumTagID(forum, cfg.SolvedTag)
+	solved := solvedTag != "" && slices.Contains(t.AppliedTags, solvedTag)
+	if solved {
+		m.resolveEscalations(t.ID, "")
+	}
+
+	changed := false
+	switch {
+	case solved && thread.SolvedAt == nil:
+		now := time.Now()
+		thread.SolvedAt = &now
+		changed = true
+	case !solved && solvedTag != "" && thread.SolvedAt != nil:
+		thread.SolvedAt = nil
+		changed = true
+	}
+
+	// Someone revived an archived thread, close it again once it goes idle
+	if thread.Archived && t.ThreadMetadata != nil && !t.ThreadMetadata.Archived {
+		thread.Archived = false
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	_, err = m.repo.UpdateThread(thread)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error updating thread in database")
+	}
+}
+
+// closeSolvedThreads archives (and optionally locks) solved threads nobody
+// has posted in for the configured idle period.
+func (m *QNA) closeSolvedThreads() {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if cfg.AutoCloseHours == 0 {
+		return
+	}
+
+	threads, err := m.repo.ReadSolvedThreads(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading threads from database")
+		return
+	}
+
+	idle := time.Duration(cfg.AutoCloseHours) * time.Hour
+	for _, thread := range threads {
+		// Activity only pushes the close back, don't ask Discord about threads
+		// that weren't solved long enough ago anyway
+		lastActivity := *thread.SolvedAt
+		if time.Since(lastActivity) < idle {
+			continue
+		}
+
+		channel, err := m.session.Channel(thread.ChannelSnowflake)
+		if err != nil {
+			m.log.Error().Err(err).Str("channel_id", thread.ChannelSnowflake).Msg("error getting thread channel")
+			if !channelGone(err) {
+				continue
+			}
+
+			// Deleted threads can't be closed, stop trying
+			thread.Archived = true
+			_, err = m.repo.UpdateThread(&thread)
+			if err != nil {
+				m.log.Error().Err(err).Msg("critical error updating thread in database")
+			}
+			continue
+		}
+
+		if channel.LastMessageID != "" {
+			ts, err := discordgo.SnowflakeTimestamp(channel.LastMessageID)
+			if err == nil && ts.After(lastActivity) {
+				lastActivity = ts
+			}
+		}
+
+		if time.Since(lastActivity) < idle {
+			continue
+		}
+
+		archived := true
+		_, err = m.session.ChannelEditComplex(thread.ChannelSnowflake, &discordgo.ChannelEdit{
+			Archived: &archived,
+			Locked:   &cfg.AutoCloseLock,
+		})
+		if err != nil {
+			m.log.Error().Err(err).Str("channel_id", thread.ChannelSnowflake).Msg("error closing thread")
+			continue
+		}
+
+		thread.Archived = true
+		_, err = m.repo.UpdateThread(&thread)
+		if err != nil {
+			m.log.Error().Err(err).Msg("critical error updating thread in database")
+			continue
+		}
+
+		m.log.Info().Str("channel_id", thread.ChannelSnowflake).Msg("solved thread closed")
+	}
+}
+
+func forumTagID(forum *discordgo.Channel, name string) string {
+	if name == "" {
+		return ""
+	}
+
+	for _, tag := range forum.AvailableTags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.ID
+		}
+	}
+
+	return ""
+}
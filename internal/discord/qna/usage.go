@@ -0,0 +1,115 @@
+package qna
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	charsPerToken = 4 // Rough estimate for English text
+
+	IntervalDay   = "day"
+	IntervalMonth = "month"
+)
+
+var ErrBudgetExhausted = errors.New("token budget exhausted")
+
+type UsageBucket struct {
+	Period       string `json:"period"`
+	Interactions int    `json:"interactions"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	Estimated    int    `json:"estimated"` // Interactions with estimated token counts
+}
+
+// estimateUsage fills in token counts the backend didn't report.
+func estimateUsage(prompt *Prompt, answer *Answer) {
+	if answer.InputTokens != 0 || answer.OutputTokens != 0 {
+		return
+	}
+
+	chars := utf8.RuneCountInString(prompt.Question) + utf8.RuneCountInString(prompt.System)
+	for _, turn := range prompt.History {
+		chars += utf8.RuneCountInString(turn.Content)
+	}
+
+	answer.InputTokens = chars / charsPerToken
+	answer.OutputTokens = utf8.RuneCountInString(answer.Text) / charsPerToken
+	answer.Estimated = true
+}
+
+// checkBudget makes sure neither the guild nor the user went over their daily
+// or monthly token budget. A budget of 0 is unlimited.
+func (m *QNA) checkBudget(cfg *QNAConfig, userSnowflake string) error {
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	budgets := []struct {
+		name  string
+		limit int
+		user  string
+		since time.Time
+	}{
+		{"guild_daily", cfg.GuildDailyTokens, "", day},
+		{"guild_monthly", cfg.GuildMonthlyTokens, "", month},
+		{"user_daily", cfg.UserDailyTokens, userSnowflake, day},
+		{"user_monthly", cfg.UserMonthlyTokens, userSnowflake, month},
+	}
+
+	for _, b := range budgets {
+		if b.limit == 0 {
+			continue
+		}
+
+		used, err := m.repo.SumTokens(m.guildSnowflake, b.user, b.since)
+		if err != nil {
+			return fmt.Errorf("unable to sum token usage: %w", err)
+		}
+
+		if used >= b.limit {
+			m.log.Info().
+				Str("budget", b.name).
+				Str("user_id", userSnowflake).
+				Int("used", used).
+				Int("limit", b.limit).
+				Msg("token budget exhausted")
+			return fmt.Errorf("%w: %s", ErrBudgetExhausted, b.name)
+		}
+	}
+
+	return nil
+}
+
+// Usage reports token usage between from and to, bucketed per day or month.
+func (m *QNA) Usage(from time.Time, to time.Time, interval string) ([]UsageBucket, error) {
+	layout := "2006-01-02"
+	if interval == IntervalMonth {
+		layout = "2006-01"
+	}
+
+	interactions, err := m.repo.ReadInteractionsBetween(m.guildSnowflake, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []UsageBucket{}
+	for _, interaction := range interactions {
+		period := interaction.CreatedAt.Format(layout)
+		if len(ret) == 0 || ret[len(ret)-1].Period != period {
+			ret = append(ret, UsageBucket{Period: period})
+		}
+
+		bucket := &ret[len(ret)-1]
+		bucket.Interactions++
+		bucket.InputTokens += interaction.InputTokens
+		bucket.OutputTokens += interaction.OutputTokens
+		if interaction.Estimated {
+			bucket.Estimated++
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+package qna
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/bwmarrin/discordgo"
+)
+
+const historyLimit = 50
+
+func isHelper(member *discordgo.Member, helperRoleId string) bool {
+	if member == nil {
+		return false
+	}
+
+	return slices.Contains(member.Roles, helperRoleId)
+}
+
+// channelGone reports whether Discord says the channel no longer exists.
+func channelGone(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Message == nil {
+		return false
+	}
+
+	return restErr.Message.Code == discordgo.ErrCodeUnknownChannel
+}
+
+func mentionsUser(msg *discordgo.Message, userId string) bool {
+	for _, user := range msg.Mentions {
+		if user.ID == userId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkTurnLimit reports whether the bot may still answer in the thread.
+func (m *QNA) checkTurnLimit(thread *database.QNAThread) bool {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return false
+	}
+
+	return thread.Turns < cfg.MaxTurns
+}
+
+// threadHistory rebuilds the conversation between the asker and the bot from
+// the thread, oldest first, skipping the message with ID skipId.
+func (m *QNA) threadHistory(thread *database.QNAThread, skipId string) []Turn {
+	msgs, err := m.session.ChannelMessages(thread.ChannelSnowflake, historyLimit, "", "", "")
+	if err != nil {
+		m.log.Error().Err(err).Msg("error fetching thread history")
+		return nil
+	}
+
+	history := []Turn{}
+	answers := make(map[string]bool)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		msg := msgs[i]
+		if msg.ID == skipId || msg.Author == nil {
+			continue
+		}
+
+		switch msg.Author.ID {
+		case m.session.State.User.ID:
+			// Only keep the model output, not the greeting
+			_, text, found := strings.Cut(msg.Content, answerSeparator)
+			if found {
+				answers[msg.ID] = true
+				history = append(history, Turn{Role: RoleAssistant, Content: text})
+				continue
+			}
+
+			// Long answers continue as replies to their first part
+			last := len(history) - 1
+			if msg.MessageReference != nil && answers[msg.MessageReference.MessageID] && last >= 0 {
+				history[last].Content += "\n\n" + msg.Content
+			}
+		case thread.AskerSnowflake:
+			history = append(history, Turn{Role: RoleUser, Content: msg.Content})
+		}
+	}
+
+	return history
+}
@@ -0,0 +1,34 @@
+package discord
+
+import "time"
+
+const sweepInterval = time.Minute
+
+// runScheduler periodically gives every loaded module a chance to run its
+// background work (reminders, sweeps, ...) until the session is closed.
+func (d *Discord) runScheduler() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.sweep()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *Discord) sweep() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, mod := range d.qna {
+		go mod.Sweep()
+	}
+
+	for _, mod := range d.verification {
+		go mod.Sweep()
+	}
+}
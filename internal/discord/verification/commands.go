@@ -1,9 +1,11 @@
 package verification
 
 import (
-	"os"
+	"errors"
+	"strings"
 
 	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/discord/templates"
 	"github.com/bwmarrin/discordgo"
 )
 
@@ -38,8 +40,40 @@ var commands = []*discordgo.ApplicationCommand{
 			},
 		},
 	},
+	{
+		Name:                     "unverify",
+		Description:              "clear a user's verification and take back their roles",
+		DefaultMemberPermissions: &manageRoles,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "to unverify",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "reason",
+				Description: "shown in the log channel",
+			},
+		},
+	},
+	{
+		Name:                     "verification",
+		Description:              "manage the verification module",
+		DefaultMemberPermissions: &manageRoles,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "duplicates",
+				Description: "list emails verifying more than one account",
+			},
+		},
+	},
 }
 
+var manageRoles int64 = discordgo.PermissionManageRoles
+
 func (m *Verification) email(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	member := i.ApplicationCommandData().Options[0].UserValue(s)
 	email, _ := m.repo.ReadEmail(i.GuildID, member.ID)
@@ -48,6 +82,8 @@ func (m *Verification) email(s *discordgo.Session, i *discordgo.InteractionCreat
 	status := "❌ Unverified"
 	if email != nil {
 		addr = email.Address
+	}
+	if email != nil && email.IsVerified {
 		status = "✅ Verified"
 	}
 
@@ -92,10 +128,12 @@ func (m *Verification) verify(s *discordgo.Session, i *discordgo.InteractionCrea
 	print("verify started")
 	member := i.ApplicationCommandData().Options[0].UserValue(s)
 	email := i.ApplicationCommandData().Options[1].StringValue()
-	email, err := m.repo.ManualVerification(i.GuildID, member.ID, email)
+	email, err := m.manualVerification(member.ID, email)
 
 	status := "❌ Manual Verification Failed"
-	if err == nil {
+	if errors.Is(err, ErrDuplicateEmail) {
+		status = "❌ Email Already Verifies The Maximum Number Of Accounts"
+	} else if err == nil {
 		status = "✅ Manual Verification Successful"
 	}
 
@@ -135,11 +173,33 @@ func (m *Verification) verify(s *discordgo.Session, i *discordgo.InteractionCrea
 		},
 	})
 
-	s.GuildMemberRoleRemove(m.guildSnowflake, i.Member.User.ID, os.Getenv("ROLE_TO_REMOVE"))
-	s.GuildMemberRoleAdd(m.guildSnowflake, i.Member.User.ID, os.Getenv("ROLE_TO_ADD"))
-
 	if err != nil {
 		m.log.Error().Err(err).Msg("Failed to manually verify email")
+		return
 	}
 
+	m.recordEvent(member.ID, EventManualVerified)
+	m.evaluateRoles(member.ID)
+
+}
+
+func (m *Verification) unverify(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	opts := i.ApplicationCommandData().Options
+	member := opts[0].UserValue(s)
+
+	reason := "by " + i.Member.User.Username
+	if len(opts) > 1 {
+		reason = strings.TrimSpace(opts[1].StringValue()) + ", " + reason
+	}
+
+	err := m.Unverify(member.ID, reason)
+	switch {
+	case errors.Is(err, ErrNotVerified):
+		templates.MessageEphemeral(s, i, "<@"+member.ID+"> isn't verified.")
+	case err != nil:
+		m.log.Error().Err(err).Str("user_id", member.ID).Msg("error unverifying user")
+		templates.MessageEphemeral(s, i, "I couldn't unverify <@"+member.ID+">, please try again later.")
+	default:
+		templates.MessageEphemeral(s, i, "<@"+member.ID+"> is no longer verified.")
+	}
 }
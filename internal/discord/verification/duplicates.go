@@ -0,0 +1,189 @@
+package verification
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/discord/templates"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	DuplicateBlock = "block" // One account per address
+	DuplicateAlert = "alert" // Any number of accounts, alerting the log channel
+	DuplicateLimit = "limit" // Up to DuplicateLimit accounts, alerting the log channel
+)
+
+var ErrDuplicateEmail = errors.New("email already verifies the maximum number of accounts")
+
+// Duplicate is an address verifying more than one account.
+type Duplicate struct {
+	Address string   `json:"address"`
+	Users   []string `json:"user_snowflakes"`
+}
+
+// duplicateAllowed applies the duplicate policy to a user about to verify an
+// address, returning the other accounts already verified with it.
+func (m *Verification) duplicateAllowed(cfg *VerificationConfig, userSnowflake string, address string) ([]string, bool, error) {
+	emails, err := m.repo.ReadVerifiedEmailsByAddress(m.guildSnowflake, address)
+	if err != nil {
+		return nil, true, err
+	}
+
+	others := []string{}
+	for _, email := range emails {
+		if email.UserSnowflake != userSnowflake {
+			others = append(others, email.UserSnowflake)
+		}
+	}
+
+	return others, cfg.duplicatesAllowed(len(others)), nil
+}
+
+// duplicatesAllowed is whether the policy lets one more account verify an
+// address already verifying the given number of others.
+func (c *VerificationConfig) duplicatesAllowed(others int) bool {
+	if others == 0 {
+		return true
+	}
+
+	switch c.DuplicatePolicy {
+	case DuplicateBlock:
+		return false
+	case DuplicateLimit:
+		return others < c.DuplicateLimit
+	default:
+		return true
+	}
+}
+
+// manualVerification verifies a member by hand, within the duplicate policy.
+func (m *Verification) manualVerification(userSnowflake string, emailPart string) (string, error) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	address := manualAddress(emailPart)
+	err = m.checkDuplicate(cfg, userSnowflake, address)
+	if err != nil {
+		return address, err
+	}
+
+	return m.repo.ManualVerification(m.guildSnowflake, userSnowflake, address)
+}
+
+// checkDuplicate enforces the duplicate policy, alerting the log channel
+// about every duplicate whether it was let through or not.
+func (m *Verification) checkDuplicate(cfg *VerificationConfig, userSnowflake string, address string) error {
+	others, allowed, err := m.duplicateAllowed(cfg, userSnowflake, address)
+	if err != nil {
+		return err
+	}
+
+	if len(others) == 0 {
+		return nil
+	}
+
+	action := "was allowed"
+	if !allowed {
+		action = "was blocked"
+	}
+
+	mentions := []string{}
+	for _, other := range others {
+		mentions = append(mentions, "<@"+other+">")
+	}
+
+	m.log.Info().
+		Str("user_id", userSnowflake).
+		Str("policy", cfg.DuplicatePolicy).
+		Int("accounts", len(others)).
+		Bool("allowed", allowed).
+		Msg("duplicate email verification")
+	msg := fmt.Sprintf("⚠️ User <@%s> %s to verify %s, which already verifies %s", userSnowflake, action, address, strings.Join(mentions, ", "))
+	m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+
+	if !allowed {
+		return ErrDuplicateEmail
+	}
+
+	return nil
+}
+
+// Duplicates lists every address verifying more than one account.
+func (m *Verification) Duplicates() ([]Duplicate, error) {
+	emails, err := m.repo.ReadDuplicateEmails(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []Duplicate{}
+	for _, email := range emails {
+		address := strings.ToLower(email.Address)
+		if len(ret) == 0 || ret[len(ret)-1].Address != address {
+			ret = append(ret, Duplicate{Address: address})
+		}
+
+		last := &ret[len(ret)-1]
+		last.Users = append(last.Users, email.UserSnowflake)
+	}
+
+	slices.SortFunc(ret, func(a, b Duplicate) int { return strings.Compare(a.Address, b.Address) })
+	return ret, nil
+}
+
+func (m *Verification) duplicates(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	dups, err := m.Duplicates()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading duplicate emails from database")
+		templates.MessageEphemeral(s, i, "I couldn't look for duplicates, please try again later.")
+		return
+	}
+
+	if len(dups) == 0 {
+		templates.MessageEphemeral(s, i, "Every verified email belongs to a single account. 🎉")
+		return
+	}
+
+	lines := []string{}
+	for _, dup := range dups {
+		users := []string{}
+		for _, user := range dup.Users {
+			users = append(users, "<@"+user+">")
+		}
+		lines = append(lines, fmt.Sprintf("**%s** → %s", dup.Address, strings.Join(users, ", ")))
+	}
+
+	description := strings.Join(lines, "\n")
+	if len(description) > 4000 {
+		// A single address can verify enough accounts to fill the embed
+		// alone, cut between its mentions then
+		cut := strings.LastIndexAny(description[:4000], "\n,")
+		if cut <= 0 {
+			cut = 4000
+			for !utf8.RuneStart(description[cut]) {
+				cut--
+			}
+		}
+		description = description[:cut] + "\n…"
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       fmt.Sprintf("Duplicate Emails (%d)", len(dups)),
+					Description: description,
+					Color:       colors.ASUMaroon,
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
@@ -0,0 +1,201 @@
+package verification
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	defaultEmailSubject = "{{.GuildName}} Verification"
+
+	defaultEmailText = `{{if .Link}}Click the link below to verify your email for {{.GuildName}}{{if .ExpiresIn}}, it expires in {{.ExpiresIn}} minutes{{end}}:
+
+{{.Link}}
+
+If the link doesn't work, use the "Enter My Code" button in Discord with this code: {{.Code}}
+{{else}}Your {{.GuildName}} verification code is: {{.Code}}
+
+Enter it with the "Enter My Code" button in Discord.
+{{end}}{{if .Support}}
+Need help? {{.Support}}
+{{end}}`
+
+	defaultEmailHTML = `<!DOCTYPE html>
+<html>
+<body style="margin:0;padding:24px;background:#f4f4f4;font-family:Arial,Helvetica,sans-serif;color:#222;">
+  <table role="presentation" width="100%" cellspacing="0" cellpadding="0" style="max-width:480px;margin:0 auto;background:#fff;border-radius:8px;">
+    <tr><td style="padding:24px;text-align:center;">
+      {{if .GuildIconURL}}<img src="{{.GuildIconURL}}" alt="" width="64" height="64" style="border-radius:50%;">{{end}}
+      <h1 style="font-size:20px;margin:12px 0;">{{.GuildName}} Verification</h1>
+      {{if .Link}}
+      <p>Click the button below to verify your email{{if .ExpiresIn}}, it expires in {{.ExpiresIn}} minutes{{end}}.</p>
+      <p><a href="{{.Link}}" style="display:inline-block;padding:12px 24px;background:#8c1d40;color:#fff;text-decoration:none;border-radius:4px;">Verify My Email</a></p>
+      <p style="font-size:13px;color:#666;">If the button doesn't work, use the "Enter My Code" button in Discord with this code:</p>
+      {{else}}
+      <p>Enter this code with the "Enter My Code" button in Discord:</p>
+      {{end}}
+      <p style="font-size:28px;letter-spacing:6px;font-weight:bold;">{{.Code}}</p>
+      {{if .Support}}<p style="font-size:13px;color:#666;">Need help? {{.Support}}</p>{{end}}
+    </td></tr>
+  </table>
+</body>
+</html>`
+)
+
+var ErrInvalidEmailTemplate = errors.New("invalid email template")
+
+// EmailData is what verification email templates are rendered with.
+type EmailData struct {
+	GuildName    string
+	GuildIconURL string
+	Code         string
+	Link         string    // Empty in code mode
+	ExpiresIn    int       // Minutes, 0 when the code doesn't expire
+	ExpiresAt    time.Time // Zero when the code doesn't expire
+	Support      string
+}
+
+// EmailMessage is a rendered verification email.
+type EmailMessage struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// EmailTemplates overrides the configured templates when previewing.
+type EmailTemplates struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// emailData fills in everything but the code and link.
+func (m *Verification) emailData(cfg *VerificationConfig) *EmailData {
+	data := &EmailData{
+		GuildName: m.guildName,
+		Support:   cfg.SupportContact,
+	}
+
+	guild, err := m.session.State.Guild(m.guildSnowflake)
+	if err == nil {
+		data.GuildIconURL = guild.IconURL("128")
+	}
+
+	return data
+}
+
+// withLink adds a verification link expiring after the given minutes.
+func (d *EmailData) withLink(link string, minutes int) *EmailData {
+	d.Link = link
+	d.ExpiresIn = minutes
+	d.ExpiresAt = time.Now().Add(time.Duration(minutes) * time.Minute)
+	return d
+}
+
+// renderEmail renders the guild's templates, the built in ones standing in
+// for any left empty.
+func renderEmail(cfg *VerificationConfig, data *EmailData) (*EmailMessage, error) {
+	subject, html, text := defaultEmailSubject, defaultEmailHTML, defaultEmailText
+	if cfg.EmailSubject != "" {
+		subject = cfg.EmailSubject
+	}
+	if cfg.EmailHTMLTemplate != "" {
+		html = cfg.EmailHTMLTemplate
+	}
+	if cfg.EmailTextTemplate != "" {
+		text = cfg.EmailTextTemplate
+	}
+
+	msg := &EmailMessage{}
+	buf := &bytes.Buffer{}
+
+	st, err := texttemplate.New("subject").Parse(subject)
+	if err != nil {
+		return nil, templateError("subject", err)
+	}
+	err = st.Execute(buf, data)
+	if err != nil {
+		return nil, templateError("subject", err)
+	}
+	msg.Subject = strings.Join(strings.Fields(buf.String()), " ") // Headers are a single line
+
+	buf.Reset()
+	ht, err := htmltemplate.New("html").Parse(html)
+	if err != nil {
+		return nil, templateError("html", err)
+	}
+	err = ht.Execute(buf, data)
+	if err != nil {
+		return nil, templateError("html", err)
+	}
+	msg.HTML = buf.String()
+
+	buf.Reset()
+	tt, err := texttemplate.New("text").Parse(text)
+	if err != nil {
+		return nil, templateError("text", err)
+	}
+	err = tt.Execute(buf, data)
+	if err != nil {
+		return nil, templateError("text", err)
+	}
+	msg.Text = buf.String()
+
+	return msg, nil
+}
+
+func templateError(part string, err error) error {
+	return fmt.Errorf("%w (%s): %w", ErrInvalidEmailTemplate, part, err)
+}
+
+// composeEmail renders the guild's email, falling back to the built in
+// templates so a broken template doesn't stop members from verifying.
+func (m *Verification) composeEmail(cfg *VerificationConfig, data *EmailData) *EmailMessage {
+	msg, err := renderEmail(cfg, data)
+	if err == nil {
+		return msg
+	}
+
+	m.log.Error().Err(err).Msg("error rendering email templates, using the defaults")
+	msg, _ = renderEmail(&VerificationConfig{}, data)
+	return msg
+}
+
+// sampleEmailData is rendered by previews and when validating templates.
+func sampleEmailData(cfg *VerificationConfig, data *EmailData, linkURL string) *EmailData {
+	data.Code = "123456"
+	if cfg.Mode == ModeLink {
+		data.withLink(linkURL, cfg.LinkExpiryMinutes)
+	}
+
+	return data
+}
+
+// PreviewEmail renders a sample verification email with the saved templates,
+// or the given ones in their place.
+func (m *Verification) PreviewEmail(override *EmailTemplates) (*EmailMessage, error) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if override != nil {
+		if override.Subject != "" {
+			cfg.EmailSubject = override.Subject
+		}
+		if override.HTML != "" {
+			cfg.EmailHTMLTemplate = override.HTML
+		}
+		if override.Text != "" {
+			cfg.EmailTextTemplate = override.Text
+		}
+	}
+
+	data := sampleEmailData(cfg, m.emailData(cfg), m.linkURL("/verify/", "sample"))
+	return renderEmail(cfg, data)
+}
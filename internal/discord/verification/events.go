@@ -0,0 +1,91 @@
+package verification
+
+import (
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+)
+
+const (
+	EventPanelClicked   = "panel_clicked"
+	EventEmailSubmitted = "email_submitted"
+	EventEmailSent      = "email_sent"
+	EventEmailFailed    = "email_failed"
+	EventEmailLimited   = "email_limited"
+	EventCodeFailed     = "code_failed"
+	EventVerified       = "verified"
+	EventManualVerified = "manual_verified"
+	EventTrustVerified  = "trusted_verified"
+)
+
+var eventKinds = []string{
+	EventPanelClicked,
+	EventEmailSubmitted,
+	EventEmailSent,
+	EventEmailFailed,
+	EventEmailLimited,
+	EventCodeFailed,
+	EventVerified,
+	EventManualVerified,
+	EventTrustVerified,
+}
+
+// Stats is the verification funnel over a time range. Conversion rates are
+// between distinct users, except the email send rate which is per email.
+type Stats struct {
+	Events     map[string]int64   `json:"events"`
+	Users      map[string]int64   `json:"users"`
+	Conversion map[string]float64 `json:"conversion"`
+}
+
+// recordEvent adds a funnel event, failing quietly as analytics shouldn't get
+// in the way of verifying.
+func (m *Verification) recordEvent(userSnowflake string, kind string) {
+	_, err := m.repo.CreateEvent(&database.VerificationEvent{
+		GuildSnowflake: m.guildSnowflake,
+		UserSnowflake:  userSnowflake,
+		Kind:           kind,
+	})
+	if err != nil {
+		m.log.Error().Err(err).Str("kind", kind).Msg("critical error inserting verification event into database")
+	}
+}
+
+// Stats counts the funnel events between from and to.
+func (m *Verification) Stats(from time.Time, to time.Time) (*Stats, error) {
+	counts, err := m.repo.CountEventsBetween(m.guildSnowflake, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Events:     map[string]int64{},
+		Users:      map[string]int64{},
+		Conversion: map[string]float64{},
+	}
+
+	// Report every kind, even without events
+	for _, kind := range eventKinds {
+		stats.Events[kind] = 0
+		stats.Users[kind] = 0
+	}
+	for _, c := range counts {
+		stats.Events[c.Kind] = c.Events
+		stats.Users[c.Kind] = c.Users
+	}
+
+	stats.Conversion["click_to_submit"] = rate(stats.Users[EventEmailSubmitted], stats.Users[EventPanelClicked])
+	stats.Conversion["submit_to_verified"] = rate(stats.Users[EventVerified], stats.Users[EventEmailSubmitted])
+	stats.Conversion["click_to_verified"] = rate(stats.Users[EventVerified], stats.Users[EventPanelClicked])
+	stats.Conversion["email_delivery"] = rate(stats.Events[EventEmailSent], stats.Events[EventEmailSent]+stats.Events[EventEmailFailed])
+
+	return stats, nil
+}
+
+func rate(n int64, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(of)
+}
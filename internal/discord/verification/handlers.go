@@ -2,9 +2,10 @@ package verification
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/avvo-na/forkman/internal/database"
@@ -35,9 +36,32 @@ func (m *Verification) handleCIDVerifyEmailBtn(
 		Str("user_name", i.Interaction.Member.User.GlobalName).
 		Logger()
 	log.Info().Msg("interaction request received")
+	m.recordEvent(i.Member.User.ID, EventPanelClicked)
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if cfg.Mode == ModeSSO {
+		err = m.sendSSOLink(s, i)
+		if err != nil {
+			log.Error().Err(err).Msg("error sending sso link to user")
+		}
+		return
+	}
+
+	// Don't ask for an address that can't be emailed yet
+	retry, err := m.sendAllowed(cfg, i.Member.User.ID, "")
+	if err != nil || !retry.IsZero() {
+		m.recordEvent(i.Member.User.ID, EventEmailLimited)
+		m.respondLimited(s, i, retry, err)
+		return
+	}
 
 	// Open up a modal!
-	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseModal,
 		Data: &discordgo.InteractionResponseData{
 			CustomID: CIDVerifyEmailModal,
@@ -76,8 +100,33 @@ func (m *Verification) handleCIDVerifyEmailModal(
 
 	// Grab email from user
 	recipient := i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
-	recipient += AllowedDomain
+	recipient = strings.ToLower(strings.TrimSpace(recipient)) + AllowedDomain
 	log.Debug().Msgf("received email from user: %s", recipient)
+	m.recordEvent(i.Member.User.ID, EventEmailSubmitted)
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	// No point sending a code for an address that can't be used, the
+	// policy is enforced (and alerted on) once the code comes back
+	_, allowed, err := m.duplicateAllowed(cfg, i.Member.User.ID, recipient)
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading emails from database")
+	}
+	if !allowed {
+		m.respondDuplicate(s, i)
+		return
+	}
+
+	retry, err := m.sendAllowed(cfg, i.Member.User.ID, recipient)
+	if err != nil || !retry.IsZero() {
+		m.recordEvent(i.Member.User.ID, EventEmailLimited)
+		m.respondLimited(s, i, retry, err)
+		return
+	}
 
 	// Not sure why I inlined this, ehhh can organize later
 	genCode := func() string {
@@ -88,28 +137,30 @@ func (m *Verification) handleCIDVerifyEmailModal(
 
 	// Log email to DB
 	code := genCode()
-	e := &database.Email{
-		GuildSnowflake: m.guildSnowflake,
-		UserSnowflake:  i.Member.User.ID,
-		Address:        recipient,
-		Code:           code,
-		IsVerified:     false,
-	}
-
-	_, err := m.repo.UpsertEmail(e)
+	err = m.repo.PendEmail(m.guildSnowflake, i.Member.User.ID, recipient, code)
 	if err != nil {
 		log.Error().Err(err).Msg("critical error inserting email into database")
 	}
 
-	sender := "forkman@devil2devil.asu.edu"
-	subject := "Devil2Devil Verification"
-	body := "Verfication Code: " + code
+	data := m.emailData(cfg)
+	data.Code = code
+	sent := "a code"
+	if cfg.Mode == ModeLink {
+		ttl := time.Duration(cfg.LinkExpiryMinutes) * time.Minute
+		data.withLink(m.linkURL("/verify/", m.signLink(i.Member.User.ID, code, ttl)), cfg.LinkExpiryMinutes)
+		sent = "a verification link"
+	}
 
 	// Send the email
-	err = sendEmail(context.TODO(), m.emailClient, sender, recipient, subject, body)
+	m.recordSend(i.Member.User.ID, recipient)
+	err = m.mailer.send(context.TODO(), cfg.Provider, cfg.SenderAddress, recipient, m.composeEmail(cfg, data))
+	sendEvent := EventEmailSent
 	if err != nil {
 		log.Error().Err(err).Msg("critical error sending email")
+		sendEvent = EventEmailFailed
+		m.recordBounce(recipient, err)
 	}
+	m.recordEvent(i.Member.User.ID, sendEvent)
 	log.Info().Msgf("sent email with id to: %s", recipient)
 
 	// Respond with embed and button
@@ -119,7 +170,7 @@ func (m *Verification) handleCIDVerifyEmailModal(
 			Embeds: []*discordgo.MessageEmbed{
 				{
 					Title:       "Submitted",
-					Description: "We have sent a code to your email (" + recipient + "). You may not have access to this email yet, this code will be forwarded to the email you used to apply to ASU.",
+					Description: "We have sent " + sent + " to your email (" + recipient + "). You may not have access to this email yet, it will be forwarded to the email you used to apply to ASU.",
 					Color:       0x00FF00, // Green color
 				},
 			},
@@ -206,7 +257,14 @@ func (m *Verification) handleCIDVerifyEmailCodeModal(
 		return
 	}
 
-	if recv != email.Code {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if !database.CheckCode(email.Code, strings.TrimSpace(recv)) {
+		m.recordEvent(i.Member.User.ID, EventCodeFailed)
 		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{
@@ -230,13 +288,17 @@ func (m *Verification) handleCIDVerifyEmailCodeModal(
 			Str("user_name", i.Member.User.Username).
 			Msg("user could not be verified")
 		msg := "❌ User <@" + email.UserSnowflake + "> could not be verified ->" + email.Address
-		s.ChannelMessageSend(os.Getenv("LOG_CHANNEL_ID"), msg)
+		s.ChannelMessageSend(cfg.LogChannelID, msg)
 
 		return
 	}
 
-	email.IsVerified = true
-	_, err = m.repo.UpdateEmail(email)
+	confirmPending(email)
+	err = m.completeVerification(cfg, email)
+	if errors.Is(err, ErrDuplicateEmail) {
+		m.respondDuplicate(s, i)
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("critical error updating verification status in database")
 		return
@@ -259,15 +321,69 @@ func (m *Verification) handleCIDVerifyEmailCodeModal(
 		log.Error().Err(err).Msg("error responding to user")
 		return
 	}
+}
 
-	s.GuildMemberRoleRemove(m.guildSnowflake, i.Member.User.ID, os.Getenv("ROLE_TO_REMOVE"))
-	s.GuildMemberRoleAdd(m.guildSnowflake, i.Member.User.ID, os.Getenv("ROLE_TO_ADD"))
+// confirmPending swaps in the address a code was sent to, once the code came
+// back. Nothing is saved until the verification completes.
+func confirmPending(email *database.Email) {
+	if email.PendingAddress == "" {
+		return
+	}
 
-	log.Debug().
-		Str("user_id", i.Member.User.ID).
-		Str("user_name", i.Member.User.Username).
-		Msg("user succesfully verified")
+	email.Address = email.PendingAddress
+	email.Provider = ProviderEmail
+	email.Subject = ""
+	email.Claims = nil
+}
+
+// completeVerification marks an email verified, swaps the member's roles and
+// logs it, whichever way the user proved ownership.
+func (m *Verification) completeVerification(cfg *VerificationConfig, email *database.Email) error {
+	err := m.checkDuplicate(cfg, email.UserSnowflake, email.Address)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	email.PendingAddress = ""
+	email.IsVerified = true
+	email.VerifiedAt = &now
+	email.TrustedFrom = ""
+	email.Reminders = 0
+	email.RemindedAt = nil
+	_, err = m.repo.UpsertEmail(email)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.applyRoles(cfg, email)
+	if err != nil {
+		m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error applying roles")
+	}
+
+	m.log.Debug().Str("user_id", email.UserSnowflake).Msg("user succesfully verified")
+	m.recordEvent(email.UserSnowflake, EventVerified)
 
 	msg := "✅ User <@" + email.UserSnowflake + "> was verified -> " + email.Address
-	s.ChannelMessageSend(os.Getenv("LOG_CHANNEL_ID"), msg)
+	m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+	return nil
+}
+
+func (m *Verification) respondDuplicate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Oh no!",
+					Description: "That email is already used to verify another account. If you think this is a mistake, please reach out to a moderator.",
+					Color:       0xFF0000, // Red color
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error responding to user")
+	}
 }
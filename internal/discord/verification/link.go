@@ -0,0 +1,160 @@
+package verification
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+)
+
+const (
+	ModeCode = "code" // Code typed back into a Discord modal
+	ModeLink = "link" // Signed link to the web server
+	ModeSSO  = "sso"  // Login with the guild's OIDC provider
+)
+
+var (
+	ErrInvalidLink = errors.New("verification link is invalid")
+	ErrExpiredLink = errors.New("verification link has expired")
+)
+
+// linkClaims is the signed payload of a verification link. The code ties an
+// email link to the latest request, so requesting a new email revokes older
+// links. SSO links don't carry a code.
+type linkClaims struct {
+	Guild  string `json:"g"`
+	User   string `json:"u"`
+	Code   string `json:"c"`
+	Expiry int64  `json:"e"`
+}
+
+// signLink builds a token of the form payload.signature, both base64url.
+func (m *Verification) signLink(userSnowflake string, code string, ttl time.Duration) string {
+	payload, _ := json.Marshal(linkClaims{
+		Guild:  m.guildSnowflake,
+		User:   userSnowflake,
+		Code:   code,
+		Expiry: time.Now().Add(ttl).Unix(),
+	})
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(m.linkMAC(encoded))
+}
+
+// checkLink verifies the signature, guild and expiry of a token.
+func (m *Verification) checkLink(token string) (*linkClaims, error) {
+	claims, err := decodeLink(token)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, sig, _ := strings.Cut(token, ".")
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, m.linkMAC(payload)) || claims.Guild != m.guildSnowflake {
+		return nil, ErrInvalidLink
+	}
+
+	if time.Now().Unix() > claims.Expiry {
+		return nil, ErrExpiredLink
+	}
+
+	return claims, nil
+}
+
+func (m *Verification) linkURL(path string, token string) string {
+	return strings.TrimRight(m.publicURL, "/") + path + token
+}
+
+func (m *Verification) linkMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, m.linkSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// LinkGuild reads the guild a token was issued for without checking the
+// signature, so the server knows which module should verify it.
+func LinkGuild(token string) (string, error) {
+	claims, err := decodeLink(token)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Guild, nil
+}
+
+// CheckLink returns the email a token was issued for without verifying it,
+// so opening a link (or a mail scanner fetching it) only asks to confirm.
+func (m *Verification) CheckLink(token string) (*database.Email, error) {
+	claims, err := m.checkLink(token)
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := m.repo.ReadEmail(m.guildSnowflake, claims.User)
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+
+	if !database.CheckCode(email.Code, claims.Code) {
+		return nil, ErrInvalidLink
+	}
+
+	return email, nil
+}
+
+// VerifyLink checks a token and verifies the email it was issued for. Links
+// are idempotent, confirming one again after verifying is not an error.
+func (m *Verification) VerifyLink(token string) (*database.Email, error) {
+	email, err := m.CheckLink(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if LinkConfirmed(email) {
+		return email, nil
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	confirmPending(email)
+	err = m.completeVerification(cfg, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+// LinkConfirmed is whether a link's email is already verified, and not
+// waiting on the link to switch to a new address.
+func LinkConfirmed(email *database.Email) bool {
+	return email.IsVerified && email.PendingAddress == ""
+}
+
+func decodeLink(token string) (*linkClaims, error) {
+	payload, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidLink
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+
+	claims := &linkClaims{}
+	err = json.Unmarshal(raw, claims)
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+
+	return claims, nil
+}
@@ -1,26 +1,177 @@
 package verification
 
-import "github.com/bwmarrin/discordgo"
+import (
+	"errors"
 
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+var ErrPanelNotFound = errors.New("verification panel could not be found")
+
+// PanelStatus is where the panel was sent and whether it's still there.
+type PanelStatus struct {
+	ChannelID string `json:"channel_id"`
+	MessageID string `json:"message_id"`
+	Exists    bool   `json:"exists"`
+}
+
+// SendVerificationPanel posts the panel and tracks it, replacing (and
+// deleting) any panel sent before.
 func (m *Verification) SendVerificationPanel(channelId string) error {
-	// Create embed message
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	embed, components := panelMessage(cfg, m.trusting())
+	msg, err := m.session.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
+		Embed:      embed,
+		Components: components,
+	})
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.repo.ReadPanel(m.guildSnowflake)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if prev != nil {
+		err = m.session.ChannelMessageDelete(prev.ChannelSnowflake, prev.MessageSnowflake)
+		if err != nil && !messageGone(err) {
+			m.log.Error().Err(err).Msg("error deleting previous verification panel")
+		}
+	}
+
+	_, err = m.repo.UpsertPanel(&database.VerificationPanel{
+		GuildSnowflake:   m.guildSnowflake,
+		ChannelSnowflake: msg.ChannelID,
+		MessageSnowflake: msg.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EditVerificationPanel updates the sent panel in place with the current
+// config.
+func (m *Verification) EditVerificationPanel() error {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	panel, err := m.readPanel()
+	if err != nil {
+		return err
+	}
+
+	embed, components := panelMessage(cfg, m.trusting())
+	_, err = m.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         panel.MessageSnowflake,
+		Channel:    panel.ChannelSnowflake,
+		Embeds:     &[]*discordgo.MessageEmbed{embed},
+		Components: &components,
+	})
+	if messageGone(err) {
+		return m.forgetPanel()
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteVerificationPanel removes the sent panel and stops tracking it.
+func (m *Verification) DeleteVerificationPanel() error {
+	panel, err := m.readPanel()
+	if err != nil {
+		return err
+	}
+
+	err = m.session.ChannelMessageDelete(panel.ChannelSnowflake, panel.MessageSnowflake)
+	if err != nil && !messageGone(err) {
+		return err
+	}
+
+	return m.repo.DeletePanel(m.guildSnowflake)
+}
+
+// Panel reports on the sent panel, checking Discord that it still exists.
+func (m *Verification) Panel() (*PanelStatus, error) {
+	panel, err := m.readPanel()
+	if errors.Is(err, ErrPanelNotFound) {
+		return &PanelStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := &PanelStatus{
+		ChannelID: panel.ChannelSnowflake,
+		MessageID: panel.MessageSnowflake,
+		Exists:    true,
+	}
+
+	_, err = m.session.ChannelMessage(panel.ChannelSnowflake, panel.MessageSnowflake)
+	if messageGone(err) {
+		status.Exists = false
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func (m *Verification) readPanel() (*database.VerificationPanel, error) {
+	panel, err := m.repo.ReadPanel(m.guildSnowflake)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPanelNotFound
+	}
+
+	return panel, err
+}
+
+// forgetPanel stops tracking a panel that was deleted from Discord.
+func (m *Verification) forgetPanel() error {
+	err := m.repo.DeletePanel(m.guildSnowflake)
+	if err != nil {
+		return err
+	}
+
+	return ErrPanelNotFound
+}
+
+// panelMessage builds the panel, offering to verify with an existing
+// verification when the guild trusts other guilds.
+func panelMessage(cfg *VerificationConfig, trusting bool) (*discordgo.MessageEmbed, []discordgo.MessageComponent) {
 	embed := &discordgo.MessageEmbed{
-		Title:       "Verification",
-		Description: "This Discord is for students admitted to Arizona State University. To get access to the full server please verify you've been accepted into Arizona State University.",
-		Color:       0x00FF00, // green color
-		Image: &discordgo.MessageEmbedImage{
-			URL: "https://i.ibb.co/MBVt8Mq/arrowfork.png",
-		},
-		Thumbnail: &discordgo.MessageEmbedThumbnail{
-			URL: "https://cdn-longterm.mee6.xyz/plugins/embeds/images/1187144343400751234/75ef7b0e26d7225d196e50f6781f683399de2431236e03092ddf06095a1f024c.png",
-		},
+		Title:       cfg.PanelTitle,
+		Description: cfg.PanelDescription,
+		Color:       cfg.PanelColor,
+	}
+
+	if cfg.PanelImageURL != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: cfg.PanelImageURL}
+	}
+
+	if cfg.PanelThumbnailURL != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: cfg.PanelThumbnailURL}
 	}
 
 	// Create button row to open email input modal
 	buttonRow := discordgo.ActionsRow{
 		Components: []discordgo.MessageComponent{
 			discordgo.Button{
-				Label: "Verify Me",
+				Label: cfg.PanelButtonLabel,
 				Style: discordgo.PrimaryButton,
 				Emoji: &discordgo.ComponentEmoji{
 					Name: "👆",
@@ -30,14 +181,25 @@ func (m *Verification) SendVerificationPanel(channelId string) error {
 		},
 	}
 
-	// Send message with embed and button
-	_, err := m.session.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
-		Embed:      embed,
-		Components: []discordgo.MessageComponent{buttonRow}, // Only button, no TextInput here
-	})
-	if err != nil {
-		return err
+	if trusting {
+		buttonRow.Components = append(buttonRow.Components, verifyExistingButton)
 	}
 
-	return nil
+	if cfg.ReviewChannelID != "" {
+		buttonRow.Components = append(buttonRow.Components, reviewButton)
+	}
+
+	return embed, []discordgo.MessageComponent{buttonRow}
+}
+
+// messageGone reports whether Discord says the message or its channel no
+// longer exists.
+func messageGone(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Message == nil {
+		return false
+	}
+
+	return restErr.Message.Code == discordgo.ErrCodeUnknownMessage ||
+		restErr.Message.Code == discordgo.ErrCodeUnknownChannel
 }
@@ -0,0 +1,229 @@
+package verification
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync/atomic"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/avvo-na/forkman/internal/discord/templates"
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+const (
+	FeedbackBounce    = "bounce"
+	FeedbackComplaint = "complaint"
+
+	userSendWindow    = time.Hour
+	guildSendWindow   = time.Hour
+	addressSendWindow = 24 * time.Hour // Across every guild
+
+	// The circuit breaker pauses every guild's emails while bounces or
+	// complaints over the window pass these rates, the SES review thresholds
+	breakerWindow        = time.Hour
+	breakerMinFeedback   = 5   // Of a kind, so a handful of sends can't trip it
+	breakerMinSends      = 100 // So a few mistyped addresses from one member can't either
+	breakerBounceRate    = 0.05
+	breakerComplaintRate = 0.001
+)
+
+var ErrMailPaused = errors.New("verification emails are paused after a spike in bounces or complaints")
+
+// mailPaused is whether the breaker was last seen open, to log it once.
+var mailPaused atomic.Bool
+
+// sendAllowed checks the circuit breaker and the send limits, returning when
+// the member can try again if a limit is reached. An empty address only
+// checks the member and guild limits.
+func (m *Verification) sendAllowed(cfg *VerificationConfig, userSnowflake string, address string) (time.Time, error) {
+	err := m.checkBreaker()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	retry := time.Time{}
+	later := func(t time.Time) {
+		if t.After(retry) {
+			retry = t
+		}
+	}
+
+	if cfg.SendCooldownSeconds > 0 || cfg.UserSendsPerHour > 0 {
+		cooldown := time.Duration(cfg.SendCooldownSeconds) * time.Second
+		times, err := m.repo.ReadSendTimes(m.guildSnowflake, userSnowflake, "", now.Add(-max(cooldown, userSendWindow)))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if cooldown > 0 {
+			later(limitRetry(times, 1, cooldown))
+		}
+		later(limitRetry(times, cfg.UserSendsPerHour, userSendWindow))
+	}
+
+	if cfg.GuildSendsPerHour > 0 {
+		times, err := m.repo.ReadSendTimes(m.guildSnowflake, "", "", now.Add(-guildSendWindow))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		later(limitRetry(times, cfg.GuildSendsPerHour, guildSendWindow))
+	}
+
+	if cfg.AddressSendsPerDay > 0 && address != "" {
+		times, err := m.repo.ReadSendTimes("", "", database.HashAddress(address), now.Add(-addressSendWindow))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		later(limitRetry(times, cfg.AddressSendsPerDay, addressSendWindow))
+	}
+
+	if retry.Before(now) {
+		return time.Time{}, nil
+	}
+
+	return retry, nil
+}
+
+// limitRetry is when a send is allowed again given the send times, oldest
+// first, or zero when the limit isn't reached.
+func limitRetry(times []time.Time, limit int, window time.Duration) time.Time {
+	if limit == 0 || len(times) < limit {
+		return time.Time{}
+	}
+
+	// Only the sends inside this window count
+	since := time.Now().Add(-window)
+	inside := []time.Time{}
+	for _, t := range times {
+		if !t.Before(since) {
+			inside = append(inside, t)
+		}
+	}
+
+	if len(inside) < limit {
+		return time.Time{}
+	}
+
+	return inside[len(inside)-limit].Add(window)
+}
+
+// recordSend counts a send towards the limits, and the breaker's send rate.
+func (m *Verification) recordSend(userSnowflake string, address string) {
+	_, err := m.repo.CreateSend(&database.VerificationSend{
+		GuildSnowflake: m.guildSnowflake,
+		UserSnowflake:  userSnowflake,
+		AddressHash:    database.HashAddress(address),
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error inserting email send into database")
+	}
+}
+
+// checkBreaker returns ErrMailPaused while bounces or complaints are spiking
+// across every guild.
+func (m *Verification) checkBreaker() error {
+	since := time.Now().Add(-breakerWindow)
+	feedback, err := m.repo.CountFeedback(since)
+	if err != nil {
+		return err
+	}
+
+	sends, err := m.repo.CountSends(since)
+	if err != nil {
+		return err
+	}
+
+	tripped := func(kind string, limit float64) bool {
+		n := feedback[kind]
+		return n >= breakerMinFeedback && sends >= breakerMinSends && float64(n)/float64(sends) >= limit
+	}
+
+	if tripped(FeedbackBounce, breakerBounceRate) || tripped(FeedbackComplaint, breakerComplaintRate) {
+		if !mailPaused.Swap(true) {
+			m.log.Warn().
+				Int64("bounces", feedback[FeedbackBounce]).
+				Int64("complaints", feedback[FeedbackComplaint]).
+				Int64("sends", sends).
+				Msg("verification emails paused")
+		}
+		return ErrMailPaused
+	}
+
+	if mailPaused.Swap(false) {
+		m.log.Info().Msg("verification emails resumed")
+	}
+
+	return nil
+}
+
+// pruneSends forgets the guild's sends once no limit looks at them anymore.
+func (m *Verification) pruneSends() {
+	err := m.repo.DeleteSendsBefore(m.guildSnowflake, time.Now().Add(-addressSendWindow))
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error deleting email sends from database")
+	}
+}
+
+// RecordMailFeedback stores bounced or complained about addresses, which
+// trip the circuit breaker when they spike.
+func RecordMailFeedback(db *gorm.DB, kind string, addresses []string) error {
+	if kind != FeedbackBounce && kind != FeedbackComplaint {
+		return fmt.Errorf("unknown mail feedback %s", kind)
+	}
+
+	repo := NewRepository(db)
+	err := repo.DeleteFeedbackBefore(time.Now().Add(-breakerWindow))
+	if err != nil {
+		return err
+	}
+
+	feedback := []database.MailFeedback{}
+	for _, address := range addresses {
+		feedback = append(feedback, database.MailFeedback{
+			Kind:        kind,
+			AddressHash: database.HashAddress(address),
+		})
+	}
+
+	return repo.CreateFeedback(feedback)
+}
+
+// recordBounce counts an email the SMTP server permanently refused as a
+// bounce, SES reports its own through notifications.
+func (m *Verification) recordBounce(address string, err error) {
+	var smtpErr *textproto.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code < 500 {
+		return
+	}
+
+	err = RecordMailFeedback(m.repo.db, FeedbackBounce, []string{address})
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error inserting mail feedback into database")
+	}
+}
+
+// respondLimited tells the member when they can request another email.
+func (m *Verification) respondLimited(s *discordgo.Session, i *discordgo.InteractionCreate, retry time.Time, err error) {
+	if errors.Is(err, ErrMailPaused) {
+		templates.MessageEphemeral(s, i, "We've paused sending verification emails for now, please try again later or reach out to a moderator.")
+		return
+	}
+
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading email sends from database")
+		templates.MessageEphemeral(s, i, "Something went wrong, please try again later.")
+		return
+	}
+
+	msg := fmt.Sprintf("You've requested too many emails, you can request another <t:%d:R>.", retry.Unix())
+	if wait := time.Until(retry); wait < time.Minute {
+		msg = fmt.Sprintf("Please wait %d seconds before requesting another email.", int(wait.Seconds())+1)
+	}
+	templates.MessageEphemeral(s, i, msg)
+}
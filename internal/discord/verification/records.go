@@ -0,0 +1,383 @@
+package verification
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+)
+
+const (
+	AddressesPlain  = "plain"
+	AddressesRedact = "redact"
+	AddressesHash   = "hash" // The keyed hash index, comparable across guilds
+
+	ProviderImport = "import"
+
+	redactMask = "***"
+)
+
+// ErrRolesBusy is returned while a re-evaluation or another import is still
+// applying roles.
+var ErrRolesBusy = errors.New("roles are already being applied in the background")
+
+var snowflakePattern = regexp.MustCompile(`^[0-9]{15,21}$`)
+
+// recordHeader is the CSV header of exports, imports accept the same columns
+// in any order.
+var recordHeader = []string{"user_snowflake", "address", "is_verified", "provider", "verified_at", "created_at", "updated_at"}
+
+// EmailRecord is an exported (or imported) verification record.
+type EmailRecord struct {
+	UserSnowflake string     `json:"user_snowflake"`
+	Address       string     `json:"address"`
+	IsVerified    bool       `json:"is_verified"`
+	Provider      string     `json:"provider"`
+	VerifiedAt    *time.Time `json:"verified_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// ImportReport is what an import did, or would do on a dry run.
+type ImportReport struct {
+	DryRun      bool          `json:"dry_run"`
+	Created     int           `json:"created"`
+	Updated     int           `json:"updated"`
+	Unchanged   int           `json:"unchanged"`
+	NotInGuild  int           `json:"not_in_guild"`
+	RolesQueued int           `json:"roles_queued"` // Applied in the background, summarised in the log channel
+	Invalid     []ImportError `json:"invalid"`
+}
+
+type ImportError struct {
+	Row           int    `json:"row"` // 1-based, not counting the CSV header
+	UserSnowflake string `json:"user_snowflake"`
+	Error         string `json:"error"`
+}
+
+// Export lists the guild's verification records, with addresses shown
+// plainly, redacted or hashed.
+func (m *Verification) Export(addresses string) ([]EmailRecord, error) {
+	emails, err := m.repo.ReadEmails(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []EmailRecord{}
+	for _, email := range emails {
+		address := email.Address
+		switch addresses {
+		case AddressesRedact:
+			address = redactAddress(address)
+		case AddressesHash:
+			address = database.HashAddress(address)
+		}
+
+		records = append(records, EmailRecord{
+			UserSnowflake: email.UserSnowflake,
+			Address:       address,
+			IsVerified:    email.IsVerified,
+			Provider:      email.Provider,
+			VerifiedAt:    email.VerifiedAt,
+			CreatedAt:     email.CreatedAt,
+			UpdatedAt:     email.UpdatedAt,
+		})
+	}
+
+	return records, nil
+}
+
+// Import bulk-upserts verified records. Nothing is written on a dry run, and
+// roles are only applied to imported members still in the guild.
+func (m *Verification) Import(records []EmailRecord, dryRun bool, applyRoles bool) (*ImportReport, error) {
+	report := &ImportReport{DryRun: dryRun, Invalid: []ImportError{}}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := m.repo.ReadEmails(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	// Members the import moves to another address no longer hold their old one
+	moved := map[string]bool{}
+	for _, record := range records {
+		if validateRecord(record) == nil {
+			moved[record.UserSnowflake] = true
+		}
+	}
+
+	byUser := map[string]database.Email{}
+	holders := map[string][]string{} // Address hash to the members verified with it
+	for _, email := range existing {
+		byUser[email.UserSnowflake] = email
+		if email.IsVerified && !moved[email.UserSnowflake] {
+			hash := database.HashAddress(email.Address)
+			holders[hash] = append(holders[hash], email.UserSnowflake)
+		}
+	}
+
+	now := time.Now()
+	seen := map[string]bool{}
+	save := []database.Email{}
+	for n, record := range records {
+		err := validateRecord(record)
+		if err == nil && seen[record.UserSnowflake] {
+			err = errors.New("user appears more than once")
+		}
+
+		address := strings.ToLower(strings.TrimSpace(record.Address))
+		hash := database.HashAddress(address)
+		if err == nil && !cfg.duplicatesAllowed(len(holders[hash])) {
+			err = ErrDuplicateEmail
+		}
+		if err != nil {
+			report.Invalid = append(report.Invalid, ImportError{Row: n + 1, UserSnowflake: record.UserSnowflake, Error: err.Error()})
+			continue
+		}
+		seen[record.UserSnowflake] = true
+		holders[hash] = append(holders[hash], record.UserSnowflake)
+		email, ok := byUser[record.UserSnowflake]
+		if ok && email.IsVerified && strings.EqualFold(email.Address, address) {
+			report.Unchanged++
+			continue
+		}
+
+		if ok {
+			report.Updated++
+		} else {
+			report.Created++
+			email = database.Email{
+				GuildSnowflake: m.guildSnowflake,
+				UserSnowflake:  record.UserSnowflake,
+			}
+		}
+
+		provider := record.Provider
+		if provider == "" {
+			provider = ProviderImport
+		}
+
+		verifiedAt := record.VerifiedAt
+		if verifiedAt == nil {
+			verifiedAt = &now
+		}
+
+		email.Address = address
+		email.PendingAddress = ""
+		email.Code = ""
+		email.IsVerified = true
+		email.Provider = provider
+		email.VerifiedAt = verifiedAt
+		email.TrustedFrom = ""
+		email.Reminders = 0
+		email.RemindedAt = nil
+		save = append(save, email)
+	}
+
+	// Only bother listing members when roles are involved
+	apply := []database.Email{}
+	if applyRoles {
+		members, err := m.members()
+		if err != nil {
+			return nil, err
+		}
+
+		present := map[string]bool{}
+		for _, member := range members {
+			present[member.User.ID] = true
+		}
+
+		for _, email := range save {
+			if !present[email.UserSnowflake] {
+				report.NotInGuild++
+				continue
+			}
+			apply = append(apply, email)
+		}
+	}
+
+	if dryRun {
+		report.RolesQueued = len(apply)
+		return report, nil
+	}
+
+	if applyRoles && !m.reevaluating.CompareAndSwap(false, true) {
+		return nil, ErrRolesBusy
+	}
+
+	err = m.repo.SaveEmails(save)
+	if err != nil {
+		if applyRoles {
+			m.reevaluating.Store(false)
+		}
+		return nil, err
+	}
+
+	m.log.Info().
+		Int("created", report.Created).
+		Int("updated", report.Updated).
+		Int("unchanged", report.Unchanged).
+		Int("invalid", len(report.Invalid)).
+		Msg("verification records imported")
+
+	if !applyRoles {
+		return report, nil
+	}
+
+	report.RolesQueued = len(apply)
+	go func() {
+		defer m.reevaluating.Store(false)
+
+		updated, failed := 0, 0
+		for _, email := range apply {
+			changed, err := m.applyRoles(cfg, &email)
+			if err != nil {
+				m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error applying imported member roles")
+				failed++
+				continue
+			}
+			if changed {
+				updated++
+			}
+		}
+
+		msg := fmt.Sprintf("📥 Imported %d verification records: %d members' roles updated, %d failed", len(save), updated, failed)
+		m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+	}()
+
+	return report, nil
+}
+
+func validateRecord(record EmailRecord) error {
+	if !snowflakePattern.MatchString(record.UserSnowflake) {
+		return errors.New("invalid user snowflake")
+	}
+
+	if !record.IsVerified {
+		return errors.New("only verified records can be imported")
+	}
+
+	// Redacted addresses are still valid addresses, so look for the mask
+	address := strings.TrimSpace(record.Address)
+	if strings.Contains(address, redactMask) {
+		return errors.New("redacted addresses can't be imported")
+	}
+
+	addr, err := mail.ParseAddress(address)
+	if err != nil || addr.Address != address {
+		return errors.New("invalid address")
+	}
+
+	return nil
+}
+
+// WriteRecordsCSV writes records with the export header.
+func WriteRecordsCSV(w io.Writer, records []EmailRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(recordHeader)
+
+	for _, r := range records {
+		verifiedAt := ""
+		if r.VerifiedAt != nil {
+			verifiedAt = r.VerifiedAt.Format(time.RFC3339)
+		}
+
+		cw.Write([]string{
+			r.UserSnowflake,
+			r.Address,
+			strconv.FormatBool(r.IsVerified),
+			r.Provider,
+			verifiedAt,
+			r.CreatedAt.Format(time.RFC3339),
+			r.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadRecordsCSV reads records written by WriteRecordsCSV. Only the user
+// snowflake and address columns are required, is_verified defaults to true.
+func ReadRecordsCSV(r io.Reader) ([]EmailRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read csv header: %w", err)
+	}
+
+	cols := map[string]int{}
+	for n, name := range header {
+		cols[strings.TrimSpace(strings.ToLower(name))] = n
+	}
+
+	for _, required := range recordHeader[:2] {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("csv is missing the %s column", required)
+		}
+	}
+
+	get := func(row []string, name string) string {
+		n, ok := cols[name]
+		if !ok || n >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[n])
+	}
+
+	records := []EmailRecord{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read csv: %w", err)
+		}
+
+		record := EmailRecord{
+			UserSnowflake: get(row, "user_snowflake"),
+			Address:       get(row, "address"),
+			IsVerified:    true,
+			Provider:      get(row, "provider"),
+		}
+
+		if v := get(row, "is_verified"); v != "" {
+			record.IsVerified, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid is_verified on row %d: %w", len(records)+1, err)
+			}
+		}
+
+		if v := get(row, "verified_at"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid verified_at on row %d: %w", len(records)+1, err)
+			}
+			record.VerifiedAt = &t
+		}
+
+		records = append(records, record)
+	}
+}
+
+// redactAddress keeps the first character and the domain, eg. j***@asu.edu.
+func redactAddress(address string) string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || local == "" {
+		return redactMask
+	}
+
+	return local[:1] + redactMask + "@" + domain
+}
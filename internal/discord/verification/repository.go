@@ -3,6 +3,7 @@ package verification
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/avvo-na/forkman/internal/database"
 	"gorm.io/gorm"
@@ -66,6 +67,76 @@ func (r *Repository) ReadEmail(guildSnowflake string, userSnowflake string) (*da
 	return e, nil
 }
 
+func (r *Repository) ReadEmails(guildSnowflake string) ([]database.Email, error) {
+	emails := []database.Email{}
+	result := r.db.Where("guild_snowflake = ?", guildSnowflake).Order("created_at").Find(&emails)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return emails, nil
+}
+
+func (r *Repository) ReadVerifiedEmails(guildSnowflake string) ([]database.Email, error) {
+	emails := []database.Email{}
+	result := r.db.Where("guild_snowflake = ? AND is_verified = ?", guildSnowflake, true).Find(&emails)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return emails, nil
+}
+
+// ReadReverifiableEmails returns the emails of a guild that are verified or
+// were verified before a re-verification was started.
+func (r *Repository) ReadReverifiableEmails(guildSnowflake string) ([]database.Email, error) {
+	emails := []database.Email{}
+	result := r.db.
+		Where("guild_snowflake = ? AND (is_verified = ? OR verified_at IS NOT NULL)", guildSnowflake, true).
+		Find(&emails)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return emails, nil
+}
+
+// ReadVerifiedEmailsByAddress returns the verified emails of a guild with the
+// given address, ignoring case. Addresses may be encrypted so this goes
+// through the hash index.
+func (r *Repository) ReadVerifiedEmailsByAddress(guildSnowflake string, address string) ([]database.Email, error) {
+	emails := []database.Email{}
+	result := r.db.
+		Where("guild_snowflake = ? AND address_hash = ? AND is_verified = ?", guildSnowflake, database.HashAddress(address), true).
+		Find(&emails)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return emails, nil
+}
+
+// ReadDuplicateEmails returns the verified emails of a guild whose address
+// verifies more than one account, grouped by address.
+func (r *Repository) ReadDuplicateEmails(guildSnowflake string) ([]database.Email, error) {
+	duplicated := r.db.Model(&database.Email{}).
+		Select("address_hash").
+		Where("guild_snowflake = ? AND is_verified = ?", guildSnowflake, true).
+		Group("address_hash").
+		Having("COUNT(*) > 1")
+
+	emails := []database.Email{}
+	result := r.db.
+		Where("guild_snowflake = ? AND is_verified = ? AND address_hash IN (?)", guildSnowflake, true, duplicated).
+		Order("address_hash, created_at").
+		Find(&emails)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return emails, nil
+}
+
 func (r *Repository) UpdateEmail(email *database.Email) (*database.Email, error) {
 	e := &database.Email{}
 	result := r.db.First(e, "guild_snowflake = ? AND user_snowflake = ?", email.GuildSnowflake, email.UserSnowflake)
@@ -74,8 +145,16 @@ func (r *Repository) UpdateEmail(email *database.Email) (*database.Email, error)
 	}
 
 	e.Address = email.Address
+	e.PendingAddress = email.PendingAddress
 	e.Code = email.Code
 	e.IsVerified = email.IsVerified
+	e.Provider = email.Provider
+	e.Subject = email.Subject
+	e.Claims = email.Claims
+	e.VerifiedAt = email.VerifiedAt
+	e.Reminders = email.Reminders
+	e.RemindedAt = email.RemindedAt
+	e.TrustedFrom = email.TrustedFrom
 
 	err := r.db.Save(e).Error
 	if err != nil {
@@ -85,6 +164,54 @@ func (r *Repository) UpdateEmail(email *database.Email) (*database.Email, error)
 	return e, nil
 }
 
+// SaveEmails creates or updates emails in a single transaction.
+func (r *Repository) SaveEmails(emails []database.Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for n := range emails {
+			if err := tx.Save(&emails[n]).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// PendEmail records the address a code was sent to. Verified members stay
+// verified with their current address until the code comes back.
+func (r *Repository) PendEmail(guildSnowflake string, userSnowflake string, address string, code string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		email := &database.Email{}
+		result := tx.Where("user_snowflake = ? AND guild_snowflake = ?", userSnowflake, guildSnowflake).First(email)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return tx.Create(&database.Email{
+				GuildSnowflake: guildSnowflake,
+				UserSnowflake:  userSnowflake,
+				Address:        address,
+				PendingAddress: address,
+				Code:           code,
+				Provider:       ProviderEmail,
+			}).Error
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+
+		email.PendingAddress = address
+		email.Code = code
+		if !email.IsVerified {
+			email.Address = address
+			email.Provider = ProviderEmail
+		}
+
+		return tx.Save(email).Error
+	})
+}
+
 func (r *Repository) UpsertEmail(email *database.Email) (*database.Email, error) {
 	err := r.db.Transaction(func(tx *gorm.DB) error {
 		existingEmail := &database.Email{}
@@ -102,8 +229,16 @@ func (r *Repository) UpsertEmail(email *database.Email) (*database.Email, error)
 		}
 
 		existingEmail.Address = email.Address
+		existingEmail.PendingAddress = email.PendingAddress
 		existingEmail.Code = email.Code
 		existingEmail.IsVerified = email.IsVerified
+		existingEmail.Provider = email.Provider
+		existingEmail.Subject = email.Subject
+		existingEmail.Claims = email.Claims
+		existingEmail.VerifiedAt = email.VerifiedAt
+		existingEmail.Reminders = email.Reminders
+		existingEmail.RemindedAt = email.RemindedAt
+		existingEmail.TrustedFrom = email.TrustedFrom
 		if err := tx.Save(existingEmail).Error; err != nil {
 			return err
 		}
@@ -117,18 +252,394 @@ func (r *Repository) UpsertEmail(email *database.Email) (*database.Email, error)
 	return email, nil
 }
 
-func (r *Repository) ManualVerification(guildSnowflake, userSnowflake, emailPart string) (string, error) {
-	// Ensure the email ends with "@asu.edu"
-	if !strings.HasSuffix(strings.ToLower(emailPart), "@asu.edu") {
-		emailPart += "@asu.edu"
+func (r *Repository) ReadUnverifiedReminders(guildSnowflake string) ([]database.UnverifiedReminder, error) {
+	reminders := []database.UnverifiedReminder{}
+	result := r.db.Where("guild_snowflake = ?", guildSnowflake).Find(&reminders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return reminders, nil
+}
+
+func (r *Repository) CreateUnverifiedReminder(reminder *database.UnverifiedReminder) (*database.UnverifiedReminder, error) {
+	result := r.db.Create(reminder)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return reminder, nil
+}
+
+func (r *Repository) DeleteUnverifiedReminder(guildSnowflake string, userSnowflake string) error {
+	return r.db.
+		Where("guild_snowflake = ? AND user_snowflake = ?", guildSnowflake, userSnowflake).
+		Delete(&database.UnverifiedReminder{}).
+		Error
+}
+
+func (r *Repository) CreateReview(review *database.VerificationReview) (*database.VerificationReview, error) {
+	result := r.db.Create(review)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return review, nil
+}
+
+func (r *Repository) ReadReviewByMessage(messageSnowflake string) (*database.VerificationReview, error) {
+	review := &database.VerificationReview{}
+	result := r.db.First(review, "message_snowflake = ?", messageSnowflake)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return review, nil
+}
+
+// ReadLatestReview returns the user's most recent review request.
+func (r *Repository) ReadLatestReview(guildSnowflake string, userSnowflake string) (*database.VerificationReview, error) {
+	review := &database.VerificationReview{}
+	result := r.db.
+		Where("guild_snowflake = ? AND user_snowflake = ?", guildSnowflake, userSnowflake).
+		Order("created_at DESC").
+		First(review)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return review, nil
+}
+
+// ReadReviews returns the reviews of a guild, oldest first, optionally only
+// those with the given status.
+func (r *Repository) ReadReviews(guildSnowflake string, status string) ([]database.VerificationReview, error) {
+	reviews := []database.VerificationReview{}
+	query := r.db.Where("guild_snowflake = ?", guildSnowflake)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	result := query.Order("created_at").Find(&reviews)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return reviews, nil
+}
+
+func (r *Repository) UpdateReview(review *database.VerificationReview) (*database.VerificationReview, error) {
+	v := &database.VerificationReview{}
+	result := r.db.First(v, "id = ?", review.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	v.MessageSnowflake = review.MessageSnowflake
+	v.Status = review.Status
+	v.ReviewerSnowflake = review.ReviewerSnowflake
+	v.Decision = review.Decision
+	v.ReviewedAt = review.ReviewedAt
+
+	err := r.db.Save(v).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (r *Repository) ReadPanel(guildSnowflake string) (*database.VerificationPanel, error) {
+	p := &database.VerificationPanel{}
+	result := r.db.First(p, "guild_snowflake = ?", guildSnowflake)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return p, nil
+}
+
+func (r *Repository) UpsertPanel(panel *database.VerificationPanel) (*database.VerificationPanel, error) {
+	p := &database.VerificationPanel{}
+	result := r.db.First(p, "guild_snowflake = ?", panel.GuildSnowflake)
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	p.GuildSnowflake = panel.GuildSnowflake
+	p.ChannelSnowflake = panel.ChannelSnowflake
+	p.MessageSnowflake = panel.MessageSnowflake
+
+	err := r.db.Save(p).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (r *Repository) DeletePanel(guildSnowflake string) error {
+	return r.db.Where("guild_snowflake = ?", guildSnowflake).Delete(&database.VerificationPanel{}).Error
+}
+
+func (r *Repository) CreateEvent(event *database.VerificationEvent) (*database.VerificationEvent, error) {
+	result := r.db.Create(event)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return event, nil
+}
+
+func (r *Repository) CreateSend(send *database.VerificationSend) (*database.VerificationSend, error) {
+	result := r.db.Create(send)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return send, nil
+}
+
+// ReadSendTimes returns when emails were sent since a time, oldest first,
+// filtered by whichever of the guild, user and address hash are given.
+func (r *Repository) ReadSendTimes(guildSnowflake string, userSnowflake string, addressHash string, since time.Time) ([]time.Time, error) {
+	query := r.db.Model(&database.VerificationSend{}).Where("created_at >= ?", since)
+	if guildSnowflake != "" {
+		query = query.Where("guild_snowflake = ?", guildSnowflake)
+	}
+	if userSnowflake != "" {
+		query = query.Where("user_snowflake = ?", userSnowflake)
+	}
+	if addressHash != "" {
+		query = query.Where("address_hash = ?", addressHash)
+	}
+
+	times := []time.Time{}
+	result := query.Order("created_at").Pluck("created_at", &times)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return times, nil
+}
+
+// CountSends counts the emails sent by every guild since a time.
+func (r *Repository) CountSends(since time.Time) (int64, error) {
+	var count int64
+	result := r.db.Model(&database.VerificationSend{}).Where("created_at >= ?", since).Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return count, nil
+}
+
+func (r *Repository) DeleteSendsBefore(guildSnowflake string, before time.Time) error {
+	return r.db.
+		Where("guild_snowflake = ? AND created_at < ?", guildSnowflake, before).
+		Delete(&database.VerificationSend{}).
+		Error
+}
+
+func (r *Repository) CreateFeedback(feedback []database.MailFeedback) error {
+	if len(feedback) == 0 {
+		return nil
+	}
+
+	return r.db.Create(&feedback).Error
+}
+
+// CountFeedback counts bounces and complaints since a time by kind.
+func (r *Repository) CountFeedback(since time.Time) (map[string]int64, error) {
+	rows := []struct {
+		Kind  string
+		Count int64
+	}{}
+	result := r.db.Model(&database.MailFeedback{}).
+		Select("kind, COUNT(*) AS count").
+		Where("created_at >= ?", since).
+		Group("kind").
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	counts := map[string]int64{}
+	for _, row := range rows {
+		counts[row.Kind] = row.Count
+	}
+
+	return counts, nil
+}
+
+func (r *Repository) DeleteFeedbackBefore(before time.Time) error {
+	return r.db.Where("created_at < ?", before).Delete(&database.MailFeedback{}).Error
+}
+
+// EventCount is the number of events, and of distinct users behind them, of
+// one kind.
+type EventCount struct {
+	Kind   string
+	Events int64
+	Users  int64
+}
+
+func (r *Repository) CountEventsBetween(guildSnowflake string, from time.Time, to time.Time) ([]EventCount, error) {
+	counts := []EventCount{}
+	result := r.db.Model(&database.VerificationEvent{}).
+		Select("kind, COUNT(*) AS events, COUNT(DISTINCT user_snowflake) AS users").
+		Where("guild_snowflake = ? AND created_at >= ? AND created_at < ?", guildSnowflake, from, to).
+		Group("kind").
+		Scan(&counts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return counts, nil
+}
+
+// ReadSourceEmail returns the user's latest verification in one of the given
+// guilds that was proven there rather than trusted from elsewhere.
+func (r *Repository) ReadSourceEmail(userSnowflake string, guildSnowflakes []string) (*database.Email, error) {
+	e := &database.Email{}
+	result := r.db.
+		Where("user_snowflake = ? AND guild_snowflake IN ? AND is_verified = ? AND trusted_from = ?", userSnowflake, guildSnowflakes, true, "").
+		Order("verified_at DESC").
+		First(e)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return e, nil
+}
+
+// ReadTrustedEmails returns the verifications of a guild trusted from another.
+func (r *Repository) ReadTrustedEmails(guildSnowflake string, sourceSnowflake string) ([]database.Email, error) {
+	emails := []database.Email{}
+	result := r.db.Where("guild_snowflake = ? AND trusted_from = ?", guildSnowflake, sourceSnowflake).Find(&emails)
+	if result.Error != nil {
+		return nil, result.Error
 	}
 
+	return emails, nil
+}
+
+func (r *Repository) CreateTrustGroup(group *database.TrustGroup) (*database.TrustGroup, error) {
+	result := r.db.Create(group)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return group, nil
+}
+
+func (r *Repository) ReadTrustGroup(id uint) (*database.TrustGroup, error) {
+	g := &database.TrustGroup{}
+	result := r.db.Preload("Members").First(g, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return g, nil
+}
+
+// ReadGuildTrustGroups returns the groups a guild is a member of or invited to.
+func (r *Repository) ReadGuildTrustGroups(guildSnowflake string) ([]database.TrustGroup, error) {
+	member := r.db.Model(&database.TrustGroupMember{}).Select("group_id").Where("guild_snowflake = ?", guildSnowflake)
+
+	groups := []database.TrustGroup{}
+	result := r.db.Preload("Members").Where("id IN (?)", member).Order("created_at").Find(&groups)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return groups, nil
+}
+
+func (r *Repository) DeleteTrustGroup(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("group_id = ?", id).Delete(&database.TrustGroupMember{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(&database.TrustGroup{}, id).Error
+	})
+}
+
+func (r *Repository) CreateTrustGroupMember(member *database.TrustGroupMember) (*database.TrustGroupMember, error) {
+	result := r.db.Create(member)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return member, nil
+}
+
+func (r *Repository) UpdateTrustGroupMember(member *database.TrustGroupMember) (*database.TrustGroupMember, error) {
+	m := &database.TrustGroupMember{}
+	result := r.db.First(m, "group_id = ? AND guild_snowflake = ?", member.GroupID, member.GuildSnowflake)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	m.Accepted = member.Accepted
+
+	err := r.db.Save(m).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (r *Repository) DeleteTrustGroupMember(groupID uint, guildSnowflake string) error {
+	return r.db.
+		Where("group_id = ? AND guild_snowflake = ?", groupID, guildSnowflake).
+		Delete(&database.TrustGroupMember{}).
+		Error
+}
+
+// ReadTrustedGuilds returns the other guilds sharing an accepted trust group
+// with a guild.
+func (r *Repository) ReadTrustedGuilds(guildSnowflake string) ([]string, error) {
+	groups := r.db.Model(&database.TrustGroupMember{}).
+		Select("group_id").
+		Where("guild_snowflake = ? AND accepted = ?", guildSnowflake, true)
+
+	guilds := []string{}
+	result := r.db.Model(&database.TrustGroupMember{}).
+		Distinct("guild_snowflake").
+		Where("group_id IN (?) AND accepted = ? AND guild_snowflake <> ?", groups, true, guildSnowflake).
+		Pluck("guild_snowflake", &guilds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return guilds, nil
+}
+
+// manualAddress turns ASURITE IDs into "@asu.edu" emails, full addresses are
+// kept as is.
+func manualAddress(emailPart string) string {
+	if !strings.Contains(emailPart, "@") {
+		return emailPart + "@asu.edu"
+	}
+
+	return emailPart
+}
+
+func (r *Repository) ManualVerification(guildSnowflake, userSnowflake, emailPart string) (string, error) {
+	emailPart = manualAddress(emailPart)
+
+	now := time.Now()
 	emailRecord := &database.Email{
 		GuildSnowflake: guildSnowflake,
 		UserSnowflake:  userSnowflake,
 		Address:        emailPart,
-		Code:           "N/A",
 		IsVerified:     true,
+		Provider:       ProviderManual,
+		VerifiedAt:     &now,
 	}
 
 	err := r.db.Transaction(func(tx *gorm.DB) error {
@@ -146,7 +657,13 @@ func (r *Repository) ManualVerification(guildSnowflake, userSnowflake, emailPart
 		// Otherwise record found; update
 		existing.Address = emailRecord.Address
 		existing.IsVerified = emailRecord.IsVerified
-		// existing.Code = emailRecord.Code if you need it
+		existing.Provider = emailRecord.Provider
+		existing.PendingAddress = ""
+		existing.Code = ""
+		existing.VerifiedAt = emailRecord.VerifiedAt
+		existing.TrustedFrom = ""
+		existing.Reminders = 0
+		existing.RemindedAt = nil
 		return tx.Save(existing).Error
 	})
 	if err != nil {
@@ -0,0 +1,224 @@
+package verification
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+var ErrNotVerified = errors.New("user is not verified")
+
+// Unverify clears a member's verification, revokes any outstanding links and
+// takes back the roles verifying gave them.
+func (m *Verification) Unverify(userSnowflake string, reason string) error {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	email, err := m.repo.ReadEmail(m.guildSnowflake, userSnowflake)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotVerified
+	}
+	if err != nil {
+		return err
+	}
+
+	if !email.IsVerified && email.VerifiedAt == nil {
+		return ErrNotVerified
+	}
+
+	// Verifications proven here are trusted by the guild's trust groups
+	source := email.TrustedFrom == ""
+
+	email.IsVerified = false
+	email.PendingAddress = ""
+	email.Code = ""
+	email.VerifiedAt = nil
+	email.TrustedFrom = ""
+	email.Reminders = 0
+	email.RemindedAt = nil
+	_, err = m.repo.UpdateEmail(email)
+	if err != nil {
+		return err
+	}
+
+	err = m.revokeRoles(cfg, email)
+	if err != nil {
+		m.log.Error().Err(err).Str("user_id", userSnowflake).Msg("error revoking roles")
+	}
+
+	if reason == "" {
+		reason = "no reason given"
+	}
+
+	m.log.Info().Str("user_id", userSnowflake).Str("reason", reason).Msg("user unverified")
+	msg := "🚫 User <@" + userSnowflake + "> was unverified (" + reason + ") -> " + email.Address
+	m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+
+	if source {
+		go m.revokeTrusted(userSnowflake, reason)
+	}
+
+	return nil
+}
+
+// revokeRoles undoes applyRoles, removing every role verification can grant
+// and giving back the base role it removes.
+func (m *Verification) revokeRoles(cfg *VerificationConfig, email *database.Email) error {
+	member, err := m.session.GuildMember(m.guildSnowflake, email.UserSnowflake)
+	if err != nil {
+		return fmt.Errorf("unable to get member: %w", err)
+	}
+
+	granted := []string{}
+	if cfg.RoleToAdd != "" {
+		granted = append(granted, cfg.RoleToAdd)
+	}
+	for _, rule := range cfg.RoleRules {
+		granted = append(granted, rule.AddRoles...)
+	}
+
+	for _, role := range granted {
+		if !slices.Contains(member.Roles, role) {
+			continue
+		}
+
+		err = m.session.GuildMemberRoleRemove(m.guildSnowflake, email.UserSnowflake, role)
+		if err != nil {
+			return fmt.Errorf("unable to remove role %s: %w", role, err)
+		}
+	}
+
+	if cfg.RoleToRemove != "" && !slices.Contains(member.Roles, cfg.RoleToRemove) {
+		err = m.session.GuildMemberRoleAdd(m.guildSnowflake, email.UserSnowflake, cfg.RoleToRemove)
+		if err != nil {
+			return fmt.Errorf("unable to add role %s: %w", cfg.RoleToRemove, err)
+		}
+	}
+
+	return nil
+}
+
+// Sweep runs the module's background work, called every minute by the
+// scheduler. A run still going when the next is due is left to finish, so
+// nobody is reminded or unverified twice.
+func (m *Verification) Sweep() {
+	if !m.sweeping.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.sweeping.Store(false)
+
+	m.pruneSends()
+
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil || !mod.Enabled {
+		return
+	}
+
+	m.remindReverifications()
+	m.sweepUnverified()
+}
+
+// remindReverifications DMs members whose verification is about to lapse and
+// unverifies those whose verification has.
+func (m *Verification) remindReverifications() {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if cfg.ReverifyMonths == 0 {
+		return
+	}
+
+	emails, err := m.repo.ReadReverifiableEmails(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading emails from database")
+		return
+	}
+
+	// Furthest reminder first
+	days := slices.Clone(cfg.ReverifyReminderDays)
+	slices.Sort(days)
+	slices.Reverse(days)
+
+	now := time.Now()
+	for _, email := range emails {
+		// Pin the fallback, saving reminders bumps UpdatedAt
+		base := verifiedAt(&email)
+		email.VerifiedAt = &base
+		expiry := base.AddDate(0, cfg.ReverifyMonths, 0)
+
+		if !now.Before(expiry) {
+			err = m.Unverify(email.UserSnowflake, "verification lapsed")
+			if err != nil {
+				m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error unverifying lapsed user")
+				continue
+			}
+
+			m.sendDM(email.UserSnowflake, &discordgo.MessageEmbed{
+				Title:       "Verification Lapsed",
+				Description: fmt.Sprintf("Your verification in **%s** has lapsed. Please verify again using the verification panel in the server to regain access.", m.guildName),
+				Color:       colors.ASUMaroon,
+			})
+			continue
+		}
+
+		// Only the latest due reminder is sent, so enabling re-verification
+		// doesn't DM members several times in a row
+		due := 0
+		for _, d := range days {
+			if !now.Before(expiry.AddDate(0, 0, -d)) {
+				due++
+			}
+		}
+		if due <= email.Reminders {
+			continue
+		}
+
+		err = m.sendDM(email.UserSnowflake, &discordgo.MessageEmbed{
+			Title:       "Verification Expiring",
+			Description: fmt.Sprintf("Your verification in **%s** expires <t:%d:R>. Please verify again using the verification panel in the server to keep your access.", m.guildName, expiry.Unix()),
+			Color:       colors.ASUMaroon,
+		})
+		if err != nil {
+			m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error sending re-verification reminder")
+		}
+
+		// Members with closed DMs are only tried once per reminder
+		email.Reminders = due
+		email.RemindedAt = &now
+		_, err = m.repo.UpdateEmail(&email)
+		if err != nil {
+			m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("critical error updating email in database")
+		}
+	}
+}
+
+func (m *Verification) sendDM(userSnowflake string, embed *discordgo.MessageEmbed) error {
+	ch, err := m.session.UserChannelCreate(userSnowflake)
+	if err != nil {
+		return fmt.Errorf("unable to open dm channel: %w", err)
+	}
+
+	_, err = m.session.ChannelMessageSendEmbed(ch.ID, embed)
+	return err
+}
+
+// verifiedAt falls back to the last update for emails verified before
+// verification times were recorded.
+func verifiedAt(email *database.Email) time.Time {
+	if email.VerifiedAt != nil {
+		return *email.VerifiedAt
+	}
+
+	return email.UpdatedAt
+}
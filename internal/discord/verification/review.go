@@ -0,0 +1,403 @@
+package verification
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/avvo-na/forkman/internal/discord/templates"
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+const (
+	ReviewPending       = "pending"
+	ReviewInfoRequested = "info_requested"
+	ReviewApproved      = "approved"
+	ReviewDenied        = "denied"
+)
+
+var (
+	CIDReviewRequestBtn   = "verify_review_button"
+	CIDReviewRequestModal = "verify_review_modal"
+	CIDReviewApproveBtn   = "verify_review_approve_button"
+	CIDReviewDenyBtn      = "verify_review_deny_button"
+	CIDReviewDenyModal    = "verify_review_deny_modal"
+	CIDReviewAskBtn       = "verify_review_ask_button"
+	CIDReviewAskModal     = "verify_review_ask_modal"
+)
+
+// reviewButton is added to the panel when the guild has a review channel.
+var reviewButton = discordgo.Button{
+	Label: "I can't access my email",
+	Style: discordgo.SecondaryButton,
+	Emoji: &discordgo.ComponentEmoji{
+		Name: "✋",
+	},
+	CustomID: CIDReviewRequestBtn,
+}
+
+// Reviews lists the review queue, optionally filtered by status.
+func (m *Verification) Reviews(status string) ([]database.VerificationReview, error) {
+	return m.repo.ReadReviews(m.guildSnowflake, status)
+}
+
+func (m *Verification) handleCIDReviewRequestBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	prev, err := m.repo.ReadLatestReview(m.guildSnowflake, i.Member.User.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		m.log.Error().Err(err).Msg("critical error reading review from database")
+		return
+	}
+
+	if prev != nil && prev.Status == ReviewPending {
+		templates.MessageEphemeral(s, i, "Your request is still waiting on staff, hang tight!")
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: CIDReviewRequestModal,
+			Title:    "Manual Verification",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  "review_name_input_field",
+							Label:     "Your full name",
+							Style:     discordgo.TextInputShort,
+							Required:  true,
+							MaxLength: 100,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  "review_email_input_field",
+							Label:     "An email you can access",
+							Style:     discordgo.TextInputShort,
+							Required:  true,
+							MaxLength: 254,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "review_note_input_field",
+							Label:       "Anything staff should know",
+							Placeholder: "eg. your admission status or ASURITE ID if you have one",
+							Style:       discordgo.TextInputParagraph,
+							MaxLength:   1000,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error sending modal to user")
+	}
+}
+
+func (m *Verification) handleCIDReviewRequestModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	if cfg.ReviewChannelID == "" {
+		templates.MessageEphemeral(s, i, "Manual verification isn't available right now, please reach out to a moderator.")
+		return
+	}
+
+	data := i.ModalSubmitData()
+	review := &database.VerificationReview{
+		GuildSnowflake: m.guildSnowflake,
+		UserSnowflake:  i.Member.User.ID,
+		Name:           strings.TrimSpace(modalValue(data, 0)),
+		AlternateEmail: strings.ToLower(strings.TrimSpace(modalValue(data, 1))),
+		Note:           strings.TrimSpace(modalValue(data, 2)),
+		Status:         ReviewPending,
+	}
+
+	review, err = m.repo.CreateReview(review)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error inserting review into database")
+		templates.MessageEphemeral(s, i, "I couldn't submit your request, please try again later.")
+		return
+	}
+
+	msg, err := m.session.ChannelMessageSendComplex(cfg.ReviewChannelID, &discordgo.MessageSend{
+		Embeds:     []*discordgo.MessageEmbed{reviewEmbed(review)},
+		Components: reviewButtons(),
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error sending review to staff channel")
+		templates.MessageEphemeral(s, i, "I couldn't reach staff, please try again later.")
+		return
+	}
+
+	review.MessageSnowflake = msg.ID
+	_, err = m.repo.UpdateReview(review)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error updating review in database")
+	}
+
+	m.log.Info().Uint("review_id", review.ID).Str("user_id", review.UserSnowflake).Msg("review requested")
+	templates.MessageEphemeral(s, i, "Thanks! Staff will review your request and get back to you in a DM.")
+}
+
+func (m *Verification) handleCIDReviewApproveBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	review := m.openReview(s, i)
+	if review == nil {
+		return
+	}
+
+	_, err := m.manualVerification(review.UserSnowflake, review.AlternateEmail)
+	if errors.Is(err, ErrDuplicateEmail) {
+		templates.MessageEphemeral(s, i, "That email already verifies the maximum number of accounts, so I can't verify this user with it.")
+		return
+	}
+	if err != nil {
+		m.log.Error().Err(err).Msg("Failed to manually verify email")
+		templates.MessageEphemeral(s, i, "I couldn't verify this user, please try again later.")
+		return
+	}
+
+	m.recordEvent(review.UserSnowflake, EventManualVerified)
+
+	// Respond before touching roles, interactions time out quickly
+	m.decideReview(s, i, review, ReviewApproved, "")
+	m.evaluateRoles(review.UserSnowflake)
+	m.sendDM(review.UserSnowflake, &discordgo.MessageEmbed{
+		Title:       "Verified!",
+		Description: fmt.Sprintf("Staff approved your request, you now have access to **%s**.", m.guildName),
+		Color:       0x00FF00, // Green color
+	})
+
+	cfg, err := m.ReadConfig()
+	if err == nil {
+		msg := "✅ User <@" + review.UserSnowflake + "> was verified by <@" + i.Member.User.ID + "> after review -> " + review.AlternateEmail
+		m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+	}
+}
+
+func (m *Verification) handleCIDReviewDenyBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if m.openReview(s, i) == nil {
+		return
+	}
+
+	m.reviewModal(s, i, CIDReviewDenyModal, "Deny Request", "Reason, sent to the user", false)
+}
+
+func (m *Verification) handleCIDReviewAskBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if m.openReview(s, i) == nil {
+		return
+	}
+
+	m.reviewModal(s, i, CIDReviewAskModal, "Ask For More Information", "Question, sent to the user", true)
+}
+
+func (m *Verification) handleCIDReviewDenyModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	review := m.openReview(s, i)
+	if review == nil {
+		return
+	}
+
+	reason := strings.TrimSpace(modalValue(i.ModalSubmitData(), 0))
+	m.decideReview(s, i, review, ReviewDenied, reason)
+
+	description := "Staff couldn't verify you from your request."
+	if reason != "" {
+		description += "\n\n> " + reason
+	}
+	m.sendDM(review.UserSnowflake, &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Verification in %s", m.guildName),
+		Description: description + "\n\nIf you think this is a mistake, please reach out to a moderator.",
+		Color:       0xFF0000, // Red color
+	})
+}
+
+func (m *Verification) handleCIDReviewAskModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	review := m.openReview(s, i)
+	if review == nil {
+		return
+	}
+
+	question := strings.TrimSpace(modalValue(i.ModalSubmitData(), 0))
+	m.decideReview(s, i, review, ReviewInfoRequested, question)
+
+	m.sendDM(review.UserSnowflake, &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Verification in %s", m.guildName),
+		Description: "Staff need a little more information to verify you:\n\n> " + question + "\n\nPlease send a new request with the \"I can't access my email\" button on the verification panel.",
+		Color:       colors.ASUMaroon,
+	})
+}
+
+// openReview loads the review behind a staff interaction, making sure the
+// reviewer may decide it and it hasn't been decided yet.
+func (m *Verification) openReview(s *discordgo.Session, i *discordgo.InteractionCreate) *database.VerificationReview {
+	if i.Member.Permissions&discordgo.PermissionManageRoles == 0 {
+		templates.MessageEphemeral(s, i, "Only staff can review verification requests.")
+		return nil
+	}
+
+	review, err := m.repo.ReadReviewByMessage(i.Message.ID)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading review from database")
+		templates.MessageEphemeral(s, i, "I couldn't find this request.")
+		return nil
+	}
+
+	if review.Status != ReviewPending {
+		templates.MessageEphemeral(s, i, "This request has already been reviewed.")
+		return nil
+	}
+
+	return review
+}
+
+// decideReview records the reviewer's decision and updates the staff embed.
+func (m *Verification) decideReview(s *discordgo.Session, i *discordgo.InteractionCreate, review *database.VerificationReview, status string, decision string) {
+	now := time.Now()
+	review.Status = status
+	review.ReviewerSnowflake = i.Member.User.ID
+	review.Decision = decision
+	review.ReviewedAt = &now
+	_, err := m.repo.UpdateReview(review)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error updating review in database")
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{reviewEmbed(review)},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error updating review message")
+	}
+
+	m.log.Info().
+		Uint("review_id", review.ID).
+		Str("reviewer_id", review.ReviewerSnowflake).
+		Str("status", status).
+		Msg("review decided")
+}
+
+func (m *Verification) reviewModal(s *discordgo.Session, i *discordgo.InteractionCreate, customID string, title string, label string, required bool) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: customID,
+			Title:    title,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  "review_decision_input_field",
+							Label:     label,
+							Style:     discordgo.TextInputParagraph,
+							Required:  required,
+							MaxLength: 1000,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("error sending modal to user")
+	}
+}
+
+func reviewEmbed(review *database.VerificationReview) *discordgo.MessageEmbed {
+	note := review.Note
+	if note == "" {
+		note = "N/A"
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("Verification Request #%d", review.ID),
+		Color: colors.ASUMaroon,
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "User",
+				Value:  "<@" + review.UserSnowflake + ">",
+				Inline: true,
+			},
+			{
+				Name:   "Name",
+				Value:  review.Name,
+				Inline: true,
+			},
+			{
+				Name:  "Alternate Email",
+				Value: review.AlternateEmail,
+			},
+			{
+				Name:  "Note",
+				Value: note,
+			},
+		},
+		Timestamp: review.CreatedAt.Format(time.RFC3339),
+	}
+
+	switch review.Status {
+	case ReviewApproved:
+		embed.Color = 0x00FF00 // Green color
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Status", Value: "✅ Approved by <@" + review.ReviewerSnowflake + ">"})
+	case ReviewDenied:
+		embed.Color = 0xFF0000 // Red color
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Status", Value: "❌ Denied by <@" + review.ReviewerSnowflake + ">"})
+	case ReviewInfoRequested:
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Status", Value: "❓ More information requested by <@" + review.ReviewerSnowflake + ">"})
+	}
+
+	if review.Decision != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Message", Value: review.Decision})
+	}
+
+	return embed
+}
+
+func reviewButtons() []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Approve",
+					Style:    discordgo.SuccessButton,
+					CustomID: CIDReviewApproveBtn,
+				},
+				discordgo.Button{
+					Label:    "Deny",
+					Style:    discordgo.DangerButton,
+					CustomID: CIDReviewDenyBtn,
+				},
+				discordgo.Button{
+					Label:    "Ask for more",
+					Style:    discordgo.SecondaryButton,
+					CustomID: CIDReviewAskBtn,
+				},
+			},
+		},
+	}
+}
+
+func modalValue(data discordgo.ModalSubmitInteractionData, row int) string {
+	if row >= len(data.Components) {
+		return ""
+	}
+
+	return data.Components[row].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+}
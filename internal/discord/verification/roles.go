@@ -0,0 +1,224 @@
+package verification
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/avvo-na/forkman/internal/database"
+)
+
+var ErrReevaluationRunning = errors.New("role re-evaluation is already running")
+
+// RoleRule grants and removes roles for verified members matching all of its
+// set conditions.
+type RoleRule struct {
+	Name        string   `json:"name" validate:"required"`
+	Domain      string   `json:"domain"`  // Matches the domain and its subdomains, eg. asu.edu
+	Pattern     string   `json:"pattern"` // Regex on the whole address
+	Claim       string   `json:"claim"`   // SSO claim, list claims match if any element does
+	Value       string   `json:"value"`   // Expected claim value
+	AddRoles    []string `json:"add_roles"`
+	RemoveRoles []string `json:"remove_roles"`
+}
+
+func (r *RoleRule) validate() error {
+	if r.Domain == "" && r.Pattern == "" && r.Claim == "" {
+		return fmt.Errorf("role rule %s has no conditions", r.Name)
+	}
+
+	if r.Pattern != "" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern in role rule %s: %w", r.Name, err)
+		}
+	}
+
+	if len(r.AddRoles) == 0 && len(r.RemoveRoles) == 0 {
+		return fmt.Errorf("role rule %s changes no roles", r.Name)
+	}
+
+	return nil
+}
+
+func (r *RoleRule) matches(email *database.Email, claims map[string]any) bool {
+	address := strings.ToLower(email.Address)
+
+	if r.Domain != "" {
+		_, domain, _ := strings.Cut(address, "@")
+		want := strings.ToLower(strings.TrimPrefix(r.Domain, "@"))
+		if domain != want && !strings.HasSuffix(domain, "."+want) {
+			return false
+		}
+	}
+
+	if r.Pattern != "" {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil || !re.MatchString(address) {
+			return false
+		}
+	}
+
+	if r.Claim != "" && !claimMatches(claims[r.Claim], r.Value) {
+		return false
+	}
+
+	return true
+}
+
+func claimMatches(claim any, value string) bool {
+	switch c := claim.(type) {
+	case nil:
+		return false
+	case []any:
+		return slices.ContainsFunc(c, func(v any) bool { return claimMatches(v, value) })
+	case string:
+		return value == "" || strings.EqualFold(c, value)
+	default:
+		return value == "" || fmt.Sprint(c) == value
+	}
+}
+
+// rolesFor works out the roles a verified member should and shouldn't have.
+// Roles granted by rules that no longer match are taken away again.
+func rolesFor(cfg *VerificationConfig, email *database.Email) ([]string, []string) {
+	claims := map[string]any{}
+	if len(email.Claims) != 0 {
+		json.Unmarshal(email.Claims, &claims)
+	}
+
+	add := []string{}
+	remove := []string{}
+	if cfg.RoleToAdd != "" {
+		add = append(add, cfg.RoleToAdd)
+	}
+	if cfg.RoleToRemove != "" {
+		remove = append(remove, cfg.RoleToRemove)
+	}
+	if cfg.QuarantineRoleID != "" {
+		remove = append(remove, cfg.QuarantineRoleID)
+	}
+
+	managed := []string{}
+	for _, rule := range cfg.RoleRules {
+		managed = append(managed, rule.AddRoles...)
+		if !rule.matches(email, claims) {
+			continue
+		}
+
+		add = append(add, rule.AddRoles...)
+		remove = append(remove, rule.RemoveRoles...)
+	}
+
+	// Granting wins over removing
+	remove = slices.DeleteFunc(remove, func(r string) bool { return slices.Contains(add, r) })
+	for _, role := range managed {
+		if !slices.Contains(add, role) && !slices.Contains(remove, role) {
+			remove = append(remove, role)
+		}
+	}
+
+	return add, remove
+}
+
+// applyRoles brings a verified member's roles in line with the config,
+// returning whether anything changed.
+func (m *Verification) applyRoles(cfg *VerificationConfig, email *database.Email) (bool, error) {
+	member, err := m.session.GuildMember(m.guildSnowflake, email.UserSnowflake)
+	if err != nil {
+		return false, fmt.Errorf("unable to get member: %w", err)
+	}
+
+	add, remove := rolesFor(cfg, email)
+	changed := false
+	for _, role := range add {
+		if slices.Contains(member.Roles, role) {
+			continue
+		}
+
+		err = m.session.GuildMemberRoleAdd(m.guildSnowflake, email.UserSnowflake, role)
+		if err != nil {
+			return changed, fmt.Errorf("unable to add role %s: %w", role, err)
+		}
+		changed = true
+	}
+
+	for _, role := range remove {
+		if !slices.Contains(member.Roles, role) {
+			continue
+		}
+
+		err = m.session.GuildMemberRoleRemove(m.guildSnowflake, email.UserSnowflake, role)
+		if err != nil {
+			return changed, fmt.Errorf("unable to remove role %s: %w", role, err)
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// ReevaluateRoles recomputes the roles of every verified member in the
+// background, posting a summary to the log channel when done.
+func (m *Verification) ReevaluateRoles() error {
+	if !m.reevaluating.CompareAndSwap(false, true) {
+		return ErrReevaluationRunning
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.reevaluating.Store(false)
+		return err
+	}
+
+	emails, err := m.repo.ReadVerifiedEmails(m.guildSnowflake)
+	if err != nil {
+		m.reevaluating.Store(false)
+		return err
+	}
+
+	go func() {
+		defer m.reevaluating.Store(false)
+
+		updated, failed := 0, 0
+		for _, email := range emails {
+			changed, err := m.applyRoles(cfg, &email)
+			if err != nil {
+				m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error re-evaluating member roles")
+				failed++
+				continue
+			}
+			if changed {
+				updated++
+			}
+		}
+
+		m.log.Info().Int("members", len(emails)).Int("updated", updated).Int("failed", failed).Msg("roles re-evaluated")
+		msg := fmt.Sprintf("🔄 Re-evaluated roles of %d verified members: %d updated, %d failed", len(emails), updated, failed)
+		m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+	}()
+
+	return nil
+}
+
+// evaluateRoles applies the roles of a single verified member.
+func (m *Verification) evaluateRoles(userSnowflake string) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	email, err := m.repo.ReadEmail(m.guildSnowflake, userSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading email from database")
+		return
+	}
+
+	_, err = m.applyRoles(cfg, email)
+	if err != nil {
+		m.log.Error().Err(err).Str("user_id", userSnowflake).Msg("error applying roles")
+	}
+}
@@ -0,0 +1,219 @@
+package verification
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/bwmarrin/discordgo"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+const (
+	ProviderEmail  = "email"
+	ProviderSSO    = "sso"
+	ProviderManual = "manual"
+
+	ssoLinkTTL  = 15 * time.Minute
+	scopeOpenID = "openid"
+)
+
+var (
+	ErrSSONotConfigured = errors.New("sso verification is not configured for this guild")
+	ErrSSONoEmail       = errors.New("identity provider did not return an email")
+	ErrSSOUnverified    = errors.New("identity provider has not verified the email")
+)
+
+var defaultSSOScopes = []string{scopeOpenID, "email", "profile"}
+
+// ssoCache holds the guild's OIDC provider, which is rebuilt (and the
+// issuer rediscovered) whenever its settings change.
+type ssoCache struct {
+	mu       sync.Mutex
+	key      string
+	provider *openidConnect.Provider
+}
+
+func (m *Verification) ssoProvider(cfg *VerificationConfig) (*openidConnect.Provider, error) {
+	if cfg.Mode != ModeSSO || cfg.SSOIssuerURL == "" || cfg.SSOClientID == "" {
+		return nil, ErrSSONotConfigured
+	}
+
+	scopes := cfg.SSOScopes
+	if len(scopes) == 0 {
+		scopes = defaultSSOScopes
+	}
+	key := strings.Join([]string{cfg.SSOIssuerURL, cfg.SSOClientID, cfg.SSOClientSecret, cfg.SSOEmailClaim, strings.Join(scopes, " ")}, "\n")
+
+	m.sso.mu.Lock()
+	defer m.sso.mu.Unlock()
+
+	if m.sso.provider != nil && m.sso.key == key {
+		return m.sso.provider, nil
+	}
+
+	discovery := strings.TrimRight(cfg.SSOIssuerURL, "/") + "/.well-known/openid-configuration"
+	p, err := openidConnect.NewNamed(
+		"oidc-"+m.guildSnowflake,
+		cfg.SSOClientID,
+		cfg.SSOClientSecret,
+		m.linkURL("/verify/sso/", "callback"),
+		discovery,
+		scopes...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover sso issuer: %w", err)
+	}
+
+	if cfg.SSOEmailClaim != "" {
+		p.EmailClaims = []string{cfg.SSOEmailClaim}
+	}
+
+	m.sso.key = key
+	m.sso.provider = p
+	return p, nil
+}
+
+// SSOLogin starts a login for the user a link was issued to. It returns the
+// provider's login URL and the session to hold on to until the callback.
+func (m *Verification) SSOLogin(token string) (string, string, error) {
+	_, err := m.checkLink(token)
+	if err != nil {
+		return "", "", err
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return "", "", err
+	}
+
+	p, err := m.ssoProvider(cfg)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The link doubles as the OAuth state, the callback checks it again
+	session, err := p.BeginAuth(token)
+	if err != nil {
+		return "", "", err
+	}
+
+	url, err := session.GetAuthURL()
+	if err != nil {
+		return "", "", err
+	}
+
+	return url, session.Marshal(), nil
+}
+
+// CompleteSSO finishes a login, binds the identity to the Discord user the
+// link was issued to and verifies them.
+func (m *Verification) CompleteSSO(token string, session string, params goth.Params) (*database.Email, error) {
+	claims, err := m.checkLink(token)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := m.ssoProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := p.UnmarshalSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Authorize(p, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authorize sso session: %w", err)
+	}
+
+	user, err := p.FetchUser(s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch sso user: %w", err)
+	}
+
+	if user.Email == "" {
+		return nil, ErrSSONoEmail
+	}
+
+	if !cfg.SSOTrustEmails && !emailVerified(user.RawData) {
+		return nil, ErrSSOUnverified
+	}
+
+	raw, err := json.Marshal(user.RawData)
+	if err != nil {
+		return nil, fmt.Errorf("critical error marshalling claims json: %w", err)
+	}
+
+	email := &database.Email{
+		GuildSnowflake: m.guildSnowflake,
+		UserSnowflake:  claims.User,
+		Address:        strings.ToLower(user.Email),
+		Provider:       ProviderSSO,
+		Subject:        user.UserID,
+		Claims:         raw,
+	}
+
+	// Saved with the verification, a member already verified stays so if it fails
+	err = m.completeVerification(cfg, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+// emailVerified reads the email_verified claim, which some issuers send as a
+// string.
+func emailVerified(claims map[string]interface{}) bool {
+	switch v := claims[openidConnect.EmailVerifiedClaim].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+
+	return false
+}
+
+// sendSSOLink answers the verify button with a personal login link.
+func (m *Verification) sendSSOLink(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	link := m.linkURL("/verify/sso/", m.signLink(i.Member.User.ID, "", ssoLinkTTL))
+
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Verify with your university login",
+					Description: fmt.Sprintf("Use the button below to sign in, the link is only for you and expires in %d minutes.", int(ssoLinkTTL.Minutes())),
+					Color:       0x00FF00, // Green color
+				},
+			},
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.Button{
+							Label: "Sign In",
+							Style: discordgo.LinkButton,
+							URL:   link,
+						},
+					},
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
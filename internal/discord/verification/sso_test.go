@@ -0,0 +1,352 @@
+package verification
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testGuild    = "100"
+	testUser     = "200"
+	testRole     = "300"
+	testClientID = "forkman"
+	testCode     = "auth-code"
+	testAddress  = "Sparky@ASU.edu"
+)
+
+// mockIssuer is a minimal OIDC provider: discovery, an authorize endpoint
+// redirecting straight back with a code, and token and userinfo endpoints.
+type mockIssuer struct {
+	*httptest.Server
+	emailVerified any
+}
+
+func newMockIssuer(t *testing.T, emailVerified any) *mockIssuer {
+	t.Helper()
+
+	p := &mockIssuer{emailVerified: emailVerified}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+		})
+	})
+
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != testClientID {
+			http.Error(w, "unknown client", http.StatusBadRequest)
+			return
+		}
+
+		callback, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+			return
+		}
+
+		params := url.Values{"code": {testCode}, "state": {q.Get("state")}}
+		callback.RawQuery = params.Encode()
+		http.Redirect(w, r, callback.String(), http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != testCode {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(),
+		})
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p.claims())
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockIssuer) claims() map[string]any {
+	claims := map[string]any{
+		"iss":   p.URL,
+		"aud":   testClientID,
+		"sub":   "sparky",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": testAddress,
+	}
+	if p.emailVerified != nil {
+		claims["email_verified"] = p.emailVerified
+	}
+
+	return claims
+}
+
+// idToken is unsigned, the provider only decodes it.
+func (p *mockIssuer) idToken() string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	payload, _ := json.Marshal(p.claims())
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+// mockDiscord answers the REST calls verifying makes, recording them.
+type mockDiscord struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (d *mockDiscord) RoundTrip(r *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	d.calls = append(d.calls, r.Method+" "+r.URL.Path)
+	d.mu.Unlock()
+
+	body := "{}"
+	if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/members/") {
+		body = `{"user":{"id":"` + testUser + `"},"roles":[]}`
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func (d *mockDiscord) called(call string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range d.calls {
+		if c == call {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newSSOModule(t *testing.T, issuer *mockIssuer, trust bool) (*Verification, *mockDiscord) {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "forkman.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&database.Module{}, &database.Email{}, &database.VerificationEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discord := &mockDiscord{}
+	session, _ := discordgo.New("Bot test")
+	session.Client = &http.Client{Transport: discord}
+
+	log := zerolog.Nop()
+	m := New("Test Guild", testGuild, "app", session, db, &Mailer{}, "https://forkman.test", []byte("link-secret"), nil, &log)
+
+	cfgJson, _ := json.Marshal(defaultConfig())
+	_, err = m.repo.CreateModule(&database.Module{GuildSnowflake: testGuild, Name: name, Config: cfgJson})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Mode = ModeSSO
+	cfg.SSOIssuerURL = issuer.URL
+	cfg.SSOClientID = testClientID
+	cfg.SSOClientSecret = "client-secret"
+	cfg.SSOTrustEmails = trust
+	cfg.RoleToAdd = testRole
+	cfg.LogChannelID = "400"
+
+	err = m.UpdateConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, discord
+}
+
+// signIn follows the login URL through the issuer, returning the parameters
+// it calls back with.
+func signIn(t *testing.T, loginURL string) url.Values {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d, want a redirect", res.StatusCode)
+	}
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(callback.String(), "https://forkman.test/verify/sso/callback") {
+		t.Fatalf("issuer redirected to %s, want the sso callback", callback)
+	}
+
+	return callback.Query()
+}
+
+func TestSSOVerification(t *testing.T) {
+	tests := []struct {
+		name          string
+		emailVerified any
+		trust         bool
+		wantErr       error
+	}{
+		{name: "verified email", emailVerified: true},
+		{name: "verified email as a string", emailVerified: "true"},
+		{name: "unverified email", emailVerified: false, wantErr: ErrSSOUnverified},
+		{name: "missing claim", wantErr: ErrSSOUnverified},
+		{name: "missing claim from a trusted issuer", trust: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newMockIssuer(t, tt.emailVerified)
+			m, discord := newSSOModule(t, issuer, tt.trust)
+
+			token := m.signLink(testUser, "", ssoLinkTTL)
+			loginURL, session, err := m.SSOLogin(token)
+			if err != nil {
+				t.Fatalf("SSOLogin: %v", err)
+			}
+
+			if !strings.HasPrefix(loginURL, issuer.URL+"/authorize") {
+				t.Fatalf("login url %s isn't the issuer's", loginURL)
+			}
+
+			params := signIn(t, loginURL)
+			if params.Get("state") != token {
+				t.Fatalf("issuer returned state %q, want the link token", params.Get("state"))
+			}
+
+			_, err = m.CompleteSSO(token, session, params)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CompleteSSO: got %v, want %v", err, tt.wantErr)
+			}
+
+			roleAdd := "PUT /api/v9/guilds/" + testGuild + "/members/" + testUser + "/roles/" + testRole
+			if tt.wantErr != nil {
+				if discord.called(roleAdd) {
+					t.Error("role added for a failed sign in")
+				}
+				return
+			}
+
+			email, err := m.repo.ReadEmail(testGuild, testUser)
+			if err != nil {
+				t.Fatalf("ReadEmail: %v", err)
+			}
+
+			if !email.IsVerified || email.Provider != ProviderSSO || email.Address != strings.ToLower(testAddress) || email.Subject != "sparky" {
+				t.Errorf("got email %+v, want a verified sso email for %s", email, strings.ToLower(testAddress))
+			}
+
+			if !discord.called(roleAdd) {
+				t.Errorf("role wasn't added, discord calls: %v", discord.calls)
+			}
+		})
+	}
+}
+
+func TestSSOLoginRejectsForeignLinks(t *testing.T) {
+	issuer := newMockIssuer(t, true)
+	m, _ := newSSOModule(t, issuer, false)
+
+	log := zerolog.Nop()
+	other := New("Test Guild", testGuild, "app", nil, nil, nil, "https://forkman.test", []byte("another-secret"), nil, &log)
+	token := other.signLink(testUser, "", ssoLinkTTL)
+
+	_, _, err := m.SSOLogin(token)
+	if !errors.Is(err, ErrInvalidLink) {
+		t.Fatalf("SSOLogin: got %v, want %v", err, ErrInvalidLink)
+	}
+}
+
+func TestSSOFailureKeepsVerification(t *testing.T) {
+	issuer := newMockIssuer(t, false)
+	m, _ := newSSOModule(t, issuer, false)
+
+	now := time.Now()
+	_, err := m.repo.UpsertEmail(&database.Email{
+		GuildSnowflake: testGuild,
+		UserSnowflake:  testUser,
+		Address:        "old@asu.edu",
+		IsVerified:     true,
+		Provider:       ProviderEmail,
+		VerifiedAt:     &now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := m.signLink(testUser, "", ssoLinkTTL)
+	loginURL, session, err := m.SSOLogin(token)
+	if err != nil {
+		t.Fatalf("SSOLogin: %v", err)
+	}
+
+	_, err = m.CompleteSSO(token, session, signIn(t, loginURL))
+	if !errors.Is(err, ErrSSOUnverified) {
+		t.Fatalf("CompleteSSO: got %v, want %v", err, ErrSSOUnverified)
+	}
+
+	email, err := m.repo.ReadEmail(testGuild, testUser)
+	if err != nil {
+		t.Fatalf("ReadEmail: %v", err)
+	}
+
+	if !email.IsVerified || email.Address != "old@asu.edu" {
+		t.Errorf("got email %+v, want the old verification kept", email)
+	}
+}
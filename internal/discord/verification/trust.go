@@ -0,0 +1,396 @@
+package verification
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/avvo-na/forkman/internal/discord/templates"
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// ProviderTrusted is copied from a verification in a trusted guild.
+const ProviderTrusted = "trusted"
+
+var CIDVerifyExistingBtn = "verify_existing_button"
+
+var (
+	ErrTrustGroupNotFound = errors.New("trust group could not be found")
+	ErrNotGroupOwner      = errors.New("only the guild that created the trust group can manage its members")
+	ErrUnknownGuild       = errors.New("guild could not be found, is the bot in it?")
+	ErrAlreadyInGroup     = errors.New("guild is already in the trust group")
+)
+
+// Peers looks up the verification module of another guild the bot is in.
+type Peers func(guildSnowflake string) (*Verification, error)
+
+// verifyExistingButton is added to the panel when the guild trusts other
+// guilds.
+var verifyExistingButton = discordgo.Button{
+	Label: "Verify With Existing",
+	Style: discordgo.SecondaryButton,
+	Emoji: &discordgo.ComponentEmoji{
+		Name: "🔗",
+	},
+	CustomID: CIDVerifyExistingBtn,
+}
+
+// TrustGroups lists the groups the guild is in or invited to.
+func (m *Verification) TrustGroups() ([]database.TrustGroup, error) {
+	return m.repo.ReadGuildTrustGroups(m.guildSnowflake)
+}
+
+// CreateTrustGroup creates a group owned by the guild, with the guild as its
+// first member.
+func (m *Verification) CreateTrustGroup(name string) (*database.TrustGroup, error) {
+	return m.repo.CreateTrustGroup(&database.TrustGroup{
+		Name:           name,
+		OwnerSnowflake: m.guildSnowflake,
+		Members: []database.TrustGroupMember{
+			{GuildSnowflake: m.guildSnowflake, Accepted: true},
+		},
+	})
+}
+
+// InviteToTrustGroup invites a guild into a group owned by this guild. The
+// guild only trusts (and is trusted) once it accepts.
+func (m *Verification) InviteToTrustGroup(groupID uint, guildSnowflake string) error {
+	group, err := m.ownedTrustGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.peers(guildSnowflake); err != nil {
+		return ErrUnknownGuild
+	}
+
+	if slices.ContainsFunc(group.Members, func(member database.TrustGroupMember) bool {
+		return member.GuildSnowflake == guildSnowflake
+	}) {
+		return ErrAlreadyInGroup
+	}
+
+	_, err = m.repo.CreateTrustGroupMember(&database.TrustGroupMember{
+		GroupID:        groupID,
+		GuildSnowflake: guildSnowflake,
+	})
+	if err != nil {
+		return err
+	}
+
+	m.log.Info().Uint("group_id", groupID).Str("invited", guildSnowflake).Msg("guild invited to trust group")
+	return nil
+}
+
+// AcceptTrustGroup accepts an invite, trusting the group's other members.
+func (m *Verification) AcceptTrustGroup(groupID uint) error {
+	group, err := m.memberTrustGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	return m.changeTrust(group, func() error {
+		_, err := m.repo.UpdateTrustGroupMember(&database.TrustGroupMember{
+			GroupID:        groupID,
+			GuildSnowflake: m.guildSnowflake,
+			Accepted:       true,
+		})
+		return err
+	})
+}
+
+// LeaveTrustGroup leaves a group, or declines its invite. The owner leaving
+// deletes the group.
+func (m *Verification) LeaveTrustGroup(groupID uint) error {
+	group, err := m.memberTrustGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	return m.changeTrust(group, func() error {
+		if group.OwnerSnowflake == m.guildSnowflake {
+			return m.repo.DeleteTrustGroup(groupID)
+		}
+
+		return m.repo.DeleteTrustGroupMember(groupID, m.guildSnowflake)
+	})
+}
+
+// RemoveFromTrustGroup removes another guild from a group owned by this guild.
+func (m *Verification) RemoveFromTrustGroup(groupID uint, guildSnowflake string) error {
+	group, err := m.ownedTrustGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	if guildSnowflake == m.guildSnowflake {
+		return m.LeaveTrustGroup(groupID)
+	}
+
+	if !slices.ContainsFunc(group.Members, func(member database.TrustGroupMember) bool {
+		return member.GuildSnowflake == guildSnowflake
+	}) {
+		return ErrUnknownGuild
+	}
+
+	return m.changeTrust(group, func() error {
+		return m.repo.DeleteTrustGroupMember(groupID, guildSnowflake)
+	})
+}
+
+// memberTrustGroup reads a group the guild is in or invited to.
+func (m *Verification) memberTrustGroup(groupID uint) (*database.TrustGroup, error) {
+	group, err := m.repo.ReadTrustGroup(groupID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTrustGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Other guilds' groups are none of our business
+	if !slices.ContainsFunc(group.Members, func(member database.TrustGroupMember) bool {
+		return member.GuildSnowflake == m.guildSnowflake
+	}) {
+		return nil, ErrTrustGroupNotFound
+	}
+
+	return group, nil
+}
+
+func (m *Verification) ownedTrustGroup(groupID uint) (*database.TrustGroup, error) {
+	group, err := m.memberTrustGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if group.OwnerSnowflake != m.guildSnowflake {
+		return nil, ErrNotGroupOwner
+	}
+
+	return group, nil
+}
+
+// changeTrust applies a change to a group, then in the background revokes
+// the verifications its members trusted from guilds they no longer trust and
+// refreshes the panels that gained or lost the verify with existing button.
+func (m *Verification) changeTrust(group *database.TrustGroup, change func() error) error {
+	before := map[string][]string{}
+	for _, member := range group.Members {
+		trusted, err := m.repo.ReadTrustedGuilds(member.GuildSnowflake)
+		if err != nil {
+			return err
+		}
+		before[member.GuildSnowflake] = trusted
+	}
+
+	err := change()
+	if err != nil {
+		return err
+	}
+
+	m.log.Info().Uint("group_id", group.ID).Msg("trust group changed")
+
+	go func() {
+		for guild, trusted := range before {
+			after, err := m.repo.ReadTrustedGuilds(guild)
+			if err != nil {
+				m.log.Error().Err(err).Str("guild", guild).Msg("critical error reading trusted guilds from database")
+				continue
+			}
+
+			peer, err := m.peers(guild)
+			if err != nil {
+				m.log.Error().Err(err).Str("guild", guild).Msg("error finding trust group member")
+				continue
+			}
+
+			for _, source := range trusted {
+				if !slices.Contains(after, source) {
+					peer.revokeTrustedFrom(source)
+				}
+			}
+
+			if (len(trusted) == 0) != (len(after) == 0) {
+				err = peer.EditVerificationPanel()
+				if err != nil && !errors.Is(err, ErrPanelNotFound) {
+					peer.log.Error().Err(err).Msg("error editing verification panel")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// revokeTrustedFrom unverifies every member whose verification was trusted
+// from a guild that's no longer trusted.
+func (m *Verification) revokeTrustedFrom(source string) {
+	emails, err := m.repo.ReadTrustedEmails(m.guildSnowflake, source)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading trusted emails from database")
+		return
+	}
+
+	for _, email := range emails {
+		err = m.Unverify(email.UserSnowflake, "the server it was trusted from is no longer trusted")
+		if err != nil && !errors.Is(err, ErrNotVerified) {
+			m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error unverifying user")
+		}
+	}
+}
+
+// revokeTrusted unverifies a member in the guilds that trusted their
+// verification here, after it was revoked.
+func (m *Verification) revokeTrusted(userSnowflake string, reason string) {
+	guilds, err := m.repo.ReadTrustedGuilds(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading trusted guilds from database")
+		return
+	}
+
+	for _, guild := range guilds {
+		peer, err := m.peers(guild)
+		if err != nil {
+			continue
+		}
+
+		email, err := peer.repo.ReadEmail(guild, userSnowflake)
+		if err != nil || email.TrustedFrom != m.guildSnowflake {
+			continue
+		}
+
+		err = peer.Unverify(userSnowflake, "revoked in "+m.guildName+", "+reason)
+		if err != nil && !errors.Is(err, ErrNotVerified) {
+			peer.log.Error().Err(err).Str("user_id", userSnowflake).Msg("error unverifying user")
+		}
+	}
+}
+
+// trusting reports whether the guild trusts any other guild.
+func (m *Verification) trusting() bool {
+	guilds, err := m.repo.ReadTrustedGuilds(m.guildSnowflake)
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading trusted guilds from database")
+		return false
+	}
+
+	return len(guilds) > 0
+}
+
+func (m *Verification) handleCIDVerifyExistingBtn(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	log := m.log.With().
+		Str("interaction_id", i.ID).
+		Str("custom_id", CIDVerifyExistingBtn).
+		Str("user_id", i.Member.User.ID).
+		Str("user_name", i.Member.User.Username).
+		Logger()
+	log.Info().Msg("interaction request received")
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	email, err := m.repo.ReadEmail(m.guildSnowflake, i.Member.User.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Error().Err(err).Msg("critical error reading email from database")
+		templates.MessageEphemeral(s, i, "Something went wrong, please try again later.")
+		return
+	}
+	if err == nil && email.IsVerified {
+		templates.MessageEphemeral(s, i, "You're already verified here!")
+		return
+	}
+
+	guilds, err := m.repo.ReadTrustedGuilds(m.guildSnowflake)
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading trusted guilds from database")
+		templates.MessageEphemeral(s, i, "Something went wrong, please try again later.")
+		return
+	}
+
+	var source *database.Email
+	if len(guilds) > 0 {
+		source, err = m.repo.ReadSourceEmail(i.Member.User.ID, guilds)
+	}
+	if source == nil && (err == nil || errors.Is(err, gorm.ErrRecordNotFound)) {
+		templates.MessageEphemeral(s, i, "You aren't verified in any server we trust, please verify with your email instead.")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("critical error reading trusted email from database")
+		templates.MessageEphemeral(s, i, "Something went wrong, please try again later.")
+		return
+	}
+
+	if email == nil {
+		email = &database.Email{
+			GuildSnowflake: m.guildSnowflake,
+			UserSnowflake:  i.Member.User.ID,
+		}
+	}
+
+	err = m.trustVerification(cfg, email, source)
+	if errors.Is(err, ErrDuplicateEmail) {
+		m.respondDuplicate(s, i)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("critical error saving trusted email to database")
+		templates.MessageEphemeral(s, i, "Something went wrong, please try again later.")
+		return
+	}
+
+	templates.MessageEphemeral(s, i, "Thank you for verifying! You now have access to our community.")
+}
+
+// trustVerification copies a verification from a trusted guild, keeping when
+// it was proven so it lapses with the original.
+func (m *Verification) trustVerification(cfg *VerificationConfig, email *database.Email, source *database.Email) error {
+	err := m.checkDuplicate(cfg, email.UserSnowflake, source.Address)
+	if err != nil {
+		return err
+	}
+
+	verifiedAt := source.VerifiedAt
+	if verifiedAt == nil {
+		now := time.Now()
+		verifiedAt = &now
+	}
+
+	email.Address = source.Address
+	email.PendingAddress = ""
+	email.Code = ""
+	email.IsVerified = true
+	email.Provider = ProviderTrusted
+	email.Subject = source.Subject
+	email.Claims = source.Claims
+	email.VerifiedAt = verifiedAt
+	email.TrustedFrom = source.GuildSnowflake
+	email.Reminders = 0
+	email.RemindedAt = nil
+	err = m.repo.SaveEmails([]database.Email{*email})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.applyRoles(cfg, email)
+	if err != nil {
+		m.log.Error().Err(err).Str("user_id", email.UserSnowflake).Msg("error applying roles")
+	}
+
+	m.recordEvent(email.UserSnowflake, EventTrustVerified)
+
+	from := source.GuildSnowflake
+	if peer, err := m.peers(from); err == nil {
+		from = peer.guildName
+	}
+
+	msg := "🔗 User <@" + email.UserSnowflake + "> was verified through " + from + " -> " + email.Address
+	m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+	return nil
+}
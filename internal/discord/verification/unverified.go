@@ -0,0 +1,306 @@
+package verification
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/avvo-na/forkman/common/colors"
+	"github.com/avvo-na/forkman/internal/database"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	UnverifiedKick       = "kick"
+	UnverifiedQuarantine = "quarantine"
+	unverifiedRemind     = "remind"
+
+	// Listing every member is expensive, and the policy is in hours anyway
+	memberSweepInterval = time.Hour
+	membersPerPage      = 1000
+
+	// Members with any of these are staff, never swept
+	staffPermissions = discordgo.PermissionAdministrator |
+		discordgo.PermissionManageServer |
+		discordgo.PermissionManageRoles |
+		discordgo.PermissionKickMembers |
+		discordgo.PermissionBanMembers |
+		discordgo.PermissionModerateMembers
+)
+
+// UnverifiedAction is what a sweep does, or would do, to a member who never
+// verified.
+type UnverifiedAction struct {
+	UserSnowflake string    `json:"user_snowflake"`
+	Username      string    `json:"username"`
+	JoinedAt      time.Time `json:"joined_at"`
+	Action        string    `json:"action"` // remind, kick or quarantine
+}
+
+// PreviewUnverified is a dry run of the unverified sweep.
+func (m *Verification) PreviewUnverified() ([]UnverifiedAction, error) {
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.planUnverified(cfg)
+}
+
+// planUnverified works out which members who never verified are due a
+// reminder or the guild's action.
+func (m *Verification) planUnverified(cfg *VerificationConfig) ([]UnverifiedAction, error) {
+	plan := []UnverifiedAction{}
+	if !cfg.unverifiedEnabled() || cfg.UnverifiedSince == nil {
+		return plan, nil
+	}
+
+	members, err := m.members()
+	if err != nil {
+		return nil, err
+	}
+
+	guild, err := m.guild()
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := m.repo.ReadReverifiableEmails(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	reminders, err := m.repo.ReadUnverifiedReminders(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	verified := map[string]bool{}
+	for _, email := range emails {
+		verified[email.UserSnowflake] = true
+	}
+
+	reminded := map[string]bool{}
+	for _, reminder := range reminders {
+		reminded[reminder.UserSnowflake] = true
+	}
+
+	now := time.Now()
+	for _, member := range members {
+		if member.User == nil || member.User.Bot || verified[member.User.ID] {
+			continue
+		}
+
+		// Members from before the policy are grandfathered in
+		if member.JoinedAt.Before(*cfg.UnverifiedSince) || unverifiedExempt(cfg, guild, member) {
+			continue
+		}
+
+		if cfg.QuarantineRoleID != "" && slices.Contains(member.Roles, cfg.QuarantineRoleID) {
+			continue
+		}
+
+		age := now.Sub(member.JoinedAt)
+		action := ""
+		switch {
+		case cfg.UnverifiedActionHours > 0 && age >= time.Duration(cfg.UnverifiedActionHours)*time.Hour:
+			action = cfg.UnverifiedAction
+		case cfg.UnverifiedReminderHours > 0 && age >= time.Duration(cfg.UnverifiedReminderHours)*time.Hour && !reminded[member.User.ID]:
+			action = unverifiedRemind
+		default:
+			continue
+		}
+
+		plan = append(plan, UnverifiedAction{
+			UserSnowflake: member.User.ID,
+			Username:      member.User.Username,
+			JoinedAt:      member.JoinedAt,
+			Action:        action,
+		})
+	}
+
+	return plan, nil
+}
+
+// sweepUnverified carries out the unverified plan at most once an hour and
+// posts a summary to the log channel. Only called from Sweep.
+func (m *Verification) sweepUnverified() {
+	if time.Since(m.lastSweep) < memberSweepInterval {
+		return
+	}
+	m.lastSweep = time.Now()
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		m.log.Error().Err(err).Msg("critical error reading config")
+		return
+	}
+
+	// Policies turned on before UnverifiedSince existed start counting now
+	if cfg.unverifiedEnabled() && cfg.UnverifiedSince == nil {
+		err = m.UpdateConfig(cfg)
+		if err != nil {
+			m.log.Error().Err(err).Msg("critical error updating config")
+		}
+		return
+	}
+
+	plan, err := m.planUnverified(cfg)
+	if err != nil {
+		m.log.Error().Err(err).Msg("error planning unverified sweep")
+		return
+	}
+
+	if len(plan) == 0 {
+		return
+	}
+
+	counts := map[string]int{}
+	failed := 0
+	for _, p := range plan {
+		err = m.actOnUnverified(cfg, p)
+		if err != nil {
+			m.log.Error().Err(err).Str("user_id", p.UserSnowflake).Str("action", p.Action).Msg("error acting on unverified member")
+			failed++
+			continue
+		}
+		counts[p.Action]++
+	}
+
+	m.log.Info().
+		Int("reminded", counts[unverifiedRemind]).
+		Int("kicked", counts[UnverifiedKick]).
+		Int("quarantined", counts[UnverifiedQuarantine]).
+		Int("failed", failed).
+		Msg("unverified members swept")
+	msg := fmt.Sprintf(
+		"🧹 Swept unverified members: %d reminded, %d kicked, %d quarantined, %d failed",
+		counts[unverifiedRemind], counts[UnverifiedKick], counts[UnverifiedQuarantine], failed,
+	)
+	m.session.ChannelMessageSend(cfg.LogChannelID, msg)
+}
+
+func (m *Verification) actOnUnverified(cfg *VerificationConfig, p UnverifiedAction) error {
+	switch p.Action {
+	case unverifiedRemind:
+		description := fmt.Sprintf("Welcome to **%s**! You haven't verified yet, please use the verification panel in the server to get access.", m.guildName)
+		if cfg.UnverifiedActionHours > 0 {
+			verb := "kicked"
+			if cfg.UnverifiedAction == UnverifiedQuarantine {
+				verb = "restricted"
+			}
+			description += fmt.Sprintf(" Members who don't verify within %d hours of joining are %s.", cfg.UnverifiedActionHours, verb)
+		}
+
+		err := m.sendDM(p.UserSnowflake, &discordgo.MessageEmbed{
+			Title:       "Verification Reminder",
+			Description: description,
+			Color:       colors.ASUMaroon,
+		})
+		if err != nil {
+			m.log.Debug().Err(err).Str("user_id", p.UserSnowflake).Msg("unable to dm unverified member")
+		}
+
+		// Members with closed DMs are only tried once
+		_, err = m.repo.CreateUnverifiedReminder(&database.UnverifiedReminder{
+			GuildSnowflake: m.guildSnowflake,
+			UserSnowflake:  p.UserSnowflake,
+		})
+		return err
+
+	case UnverifiedKick:
+		reason := fmt.Sprintf("did not verify within %d hours", cfg.UnverifiedActionHours)
+		err := m.session.GuildMemberDeleteWithReason(m.guildSnowflake, p.UserSnowflake, reason)
+		if err != nil {
+			return err
+		}
+
+		// Rejoining starts over
+		return m.repo.DeleteUnverifiedReminder(m.guildSnowflake, p.UserSnowflake)
+
+	case UnverifiedQuarantine:
+		return m.session.GuildMemberRoleAdd(m.guildSnowflake, p.UserSnowflake, cfg.QuarantineRoleID)
+	}
+
+	return fmt.Errorf("unknown unverified action %s", p.Action)
+}
+
+func (c *VerificationConfig) unverifiedEnabled() bool {
+	return c.UnverifiedReminderHours > 0 || c.UnverifiedActionHours > 0
+}
+
+// unverifiedSince keeps when the unverified policy was turned on, starting
+// over when it's turned back on after being off.
+func unverifiedSince(prev *VerificationConfig, cfg *VerificationConfig) *time.Time {
+	if !cfg.unverifiedEnabled() {
+		return nil
+	}
+
+	if prev.unverifiedEnabled() && prev.UnverifiedSince != nil {
+		return prev.UnverifiedSince
+	}
+
+	now := time.Now()
+	return &now
+}
+
+// unverifiedExempt is whether the sweep leaves a member alone: staff, members
+// given the verified role by hand and holders of the guild's exempt roles.
+func unverifiedExempt(cfg *VerificationConfig, guild *discordgo.Guild, member *discordgo.Member) bool {
+	if member.User.ID == guild.OwnerID {
+		return true
+	}
+
+	if cfg.RoleToAdd != "" && slices.Contains(member.Roles, cfg.RoleToAdd) {
+		return true
+	}
+
+	for _, role := range cfg.UnverifiedExemptRoles {
+		if slices.Contains(member.Roles, role) {
+			return true
+		}
+	}
+
+	var permissions int64
+	for _, role := range guild.Roles {
+		// The @everyone role shares the guild's ID
+		if role.ID == guild.ID || slices.Contains(member.Roles, role.ID) {
+			permissions |= role.Permissions
+		}
+	}
+
+	return permissions&staffPermissions != 0
+}
+
+// guild reads the guild with its roles, from the state when it can.
+func (m *Verification) guild() (*discordgo.Guild, error) {
+	guild, err := m.session.State.Guild(m.guildSnowflake)
+	if err == nil {
+		return guild, nil
+	}
+
+	guild, err = m.session.Guild(m.guildSnowflake)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get guild: %w", err)
+	}
+
+	return guild, nil
+}
+
+// members lists every member of the guild, a page at a time.
+func (m *Verification) members() ([]*discordgo.Member, error) {
+	members := []*discordgo.Member{}
+	after := ""
+	for {
+		page, err := m.session.GuildMembers(m.guildSnowflake, after, membersPerPage)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list guild members: %w", err)
+		}
+
+		members = append(members, page...)
+		if len(page) < membersPerPage {
+			return members, nil
+		}
+		after = page[len(page)-1].User.ID
+	}
+}
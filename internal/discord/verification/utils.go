@@ -1,15 +1,56 @@
 package verification
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 	"github.com/aws/aws-sdk-go-v2/service/ses/types"
 	"github.com/aws/aws-sdk-go/aws"
 )
 
-func sendEmail(ctx context.Context, client *ses.Client, sender, recipient, subject, body string) error {
+const (
+	MailSES  = "ses"
+	MailSMTP = "smtp"
+)
+
+var ErrSMTPNotConfigured = errors.New("smtp is not configured for this bot")
+
+// Mailer sends verification emails through SES, or the SMTP server for guilds
+// using the smtp provider.
+type Mailer struct {
+	SES  *ses.Client
+	SMTP *SMTPConfig // Nil without an SMTP server
+}
+
+// SMTPConfig is an SMTP server accepting STARTTLS, usually on port 587.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (m *Mailer) send(ctx context.Context, provider string, sender string, recipient string, msg *EmailMessage) error {
+	if provider == MailSMTP {
+		return m.sendSMTP(sender, recipient, msg)
+	}
+
+	return sendEmail(ctx, m.SES, sender, recipient, msg)
+}
+
+func sendEmail(ctx context.Context, client *ses.Client, sender string, recipient string, msg *EmailMessage) error {
 	// Input parameters for SendEmail
 	input := &ses.SendEmailInput{
 		Destination: &types.Destination{
@@ -17,12 +58,18 @@ func sendEmail(ctx context.Context, client *ses.Client, sender, recipient, subje
 		},
 		Message: &types.Message{
 			Body: &types.Body{
+				Html: &types.Content{
+					Charset: aws.String("UTF-8"),
+					Data:    aws.String(msg.HTML),
+				},
 				Text: &types.Content{
-					Data: aws.String(body),
+					Charset: aws.String("UTF-8"),
+					Data:    aws.String(msg.Text),
 				},
 			},
 			Subject: &types.Content{
-				Data: aws.String(subject),
+				Charset: aws.String("UTF-8"),
+				Data:    aws.String(msg.Subject),
 			},
 		},
 		Source: aws.String(sender),
@@ -35,3 +82,74 @@ func sendEmail(ctx context.Context, client *ses.Client, sender, recipient, subje
 	}
 	return nil
 }
+
+func (m *Mailer) sendSMTP(sender string, recipient string, msg *EmailMessage) error {
+	if m.SMTP == nil || m.SMTP.Host == "" {
+		return ErrSMTPNotConfigured
+	}
+
+	body, err := multipartEmail(sender, recipient, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", m.SMTP.Username, m.SMTP.Password, m.SMTP.Host)
+	}
+
+	addr := net.JoinHostPort(m.SMTP.Host, strconv.Itoa(m.SMTP.Port))
+	err = smtp.SendMail(addr, auth, sender, []string{recipient}, body)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// multipartEmail builds a multipart/alternative message, the text part first
+// so clients prefer the HTML one.
+func multipartEmail(sender string, recipient string, msg *EmailMessage) ([]byte, error) {
+	if strings.ContainsAny(sender+recipient, "\r\n") {
+		return nil, errors.New("addresses can't contain line breaks")
+	}
+
+	buf := &bytes.Buffer{}
+	parts := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: %s\r\n", sender)
+	fmt.Fprintf(buf, "To: %s\r\n", recipient)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		_, err = qp.Write([]byte(part.body))
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := parts.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
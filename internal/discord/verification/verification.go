@@ -4,17 +4,117 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"github.com/avvo-na/forkman/internal/database"
-	"github.com/aws/aws-sdk-go-v2/service/ses"
 	"github.com/bwmarrin/discordgo"
 	"github.com/rs/zerolog"
 	"gorm.io/gorm"
 )
 
 type VerificationConfig struct {
-	Provider      string `json:"provider"`
-	SenderAddress string `json:"sender_address"`
+	Provider      string `json:"provider" validate:"omitempty,oneof=ses smtp"` // How emails are sent, SES when empty
+	SenderAddress string `json:"sender_address" validate:"omitempty,email"`
+
+	// Email templates, rendered with EmailData. The subject and text use
+	// text/template, the HTML html/template, and empty ones the built in
+	EmailSubject      string `json:"email_subject" validate:"max=1000"`
+	EmailHTMLTemplate string `json:"email_html_template" validate:"max=100000"`
+	EmailTextTemplate string `json:"email_text_template" validate:"max=100000"`
+	SupportContact    string `json:"support_contact" validate:"max=200"` // Shown at the bottom of emails
+
+	// Flow
+	Mode              string `json:"mode" validate:"oneof=code link sso"` // Link emails keep the code as a fallback
+	LinkExpiryMinutes int    `json:"link_expiry_minutes" validate:"gte=1"`
+
+	// SSO, register {public url}/verify/sso/callback as the redirect URI
+	SSOIssuerURL    string   `json:"sso_issuer_url" validate:"omitempty,url"`
+	SSOClientID     string   `json:"sso_client_id"`
+	SSOClientSecret string   `json:"sso_client_secret"`
+	SSOScopes       []string `json:"sso_scopes"`       // Defaults to openid, email and profile
+	SSOEmailClaim   string   `json:"sso_email_claim"`  // Defaults to email
+	SSOTrustEmails  bool     `json:"sso_trust_emails"` // Skip the email_verified check, for issuers that only hand out their own addresses
+
+	// Duplicates, an address verifying several accounts
+	DuplicatePolicy string `json:"duplicate_policy" validate:"oneof=block alert limit"`
+	DuplicateLimit  int    `json:"duplicate_limit" validate:"gte=1"` // Accounts per address for the limit policy
+
+	// Re-verification, members are reminded the given days before lapsing
+	ReverifyMonths       int   `json:"reverify_months" validate:"gte=0"` // 0 disables re-verification
+	ReverifyReminderDays []int `json:"reverify_reminder_days" validate:"dive,gte=1"`
+
+	// Members who never verify, counted from when they joined
+	UnverifiedReminderHours int        `json:"unverified_reminder_hours" validate:"gte=0"` // 0 disables the reminder DM
+	UnverifiedActionHours   int        `json:"unverified_action_hours" validate:"gte=0"`   // 0 disables the action
+	UnverifiedAction        string     `json:"unverified_action" validate:"oneof=kick quarantine"`
+	QuarantineRoleID        string     `json:"quarantine_role_id"`      // Removed again once the member verifies
+	UnverifiedExemptRoles   []string   `json:"unverified_exempt_roles"` // Staff and RoleToAdd holders are always exempt
+	UnverifiedSince         *time.Time `json:"unverified_since"`        // Set when the policy is turned on, earlier joins are left alone
+
+	// Email send limits, 0 disables a limit. Addresses are limited across
+	// every guild
+	SendCooldownSeconds int `json:"send_cooldown_seconds" validate:"gte=0"` // Between a member's emails
+	UserSendsPerHour    int `json:"user_sends_per_hour" validate:"gte=0"`
+	GuildSendsPerHour   int `json:"guild_sends_per_hour" validate:"gte=0"`
+	AddressSendsPerDay  int `json:"address_sends_per_day" validate:"gte=0"`
+
+	// Panel, edit the sent panel to apply changes
+	PanelTitle        string `json:"panel_title" validate:"required,max=256"`
+	PanelDescription  string `json:"panel_description" validate:"required,max=4096"`
+	PanelColor        int    `json:"panel_color" validate:"gte=0,lte=16777215"`
+	PanelImageURL     string `json:"panel_image_url" validate:"omitempty,url"`
+	PanelThumbnailURL string `json:"panel_thumbnail_url" validate:"omitempty,url"`
+	PanelButtonLabel  string `json:"panel_button_label" validate:"required,max=80"`
+
+	// Manual review for members who can't receive email
+	ReviewChannelID string `json:"review_channel_id"` // Empty hides the panel button
+
+	// Roles & logging, rules are applied on top of the base roles
+	RoleToAdd    string     `json:"role_to_add"`
+	RoleToRemove string     `json:"role_to_remove"`
+	RoleRules    []RoleRule `json:"role_rules" validate:"dive"`
+	LogChannelID string     `json:"log_channel_id"`
+}
+
+// Validate checks what the struct tags can't, ie. that role rules compile and
+// the selected mode is fully configured.
+func (c *VerificationConfig) Validate() error {
+	for _, rule := range c.RoleRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.UnverifiedActionHours > 0 && c.UnverifiedAction == UnverifiedQuarantine && c.QuarantineRoleID == "" {
+		return errors.New("the quarantine action requires a quarantine role")
+	}
+
+	if c.UnverifiedReminderHours > 0 && c.UnverifiedActionHours > 0 && c.UnverifiedReminderHours >= c.UnverifiedActionHours {
+		return errors.New("unverified members must be reminded before they are acted on")
+	}
+
+	// Catch templates that parse but can't be rendered
+	sample := sampleEmailData(c, &EmailData{GuildName: "Sample"}, "https://example.com/verify/sample")
+	if _, err := renderEmail(c, sample); err != nil {
+		return err
+	}
+
+	if c.Mode != ModeSSO {
+		return nil
+	}
+
+	if c.SSOIssuerURL == "" || c.SSOClientID == "" || c.SSOClientSecret == "" {
+		return errors.New("sso mode requires an issuer url, client id and client secret")
+	}
+
+	if len(c.SSOScopes) != 0 && !slices.Contains(c.SSOScopes, scopeOpenID) {
+		return fmt.Errorf("sso scopes must include %s", scopeOpenID)
+	}
+
+	return nil
 }
 
 type Verification struct {
@@ -22,7 +122,14 @@ type Verification struct {
 	guildSnowflake string
 	appId          string
 	session        *discordgo.Session
-	emailClient    *ses.Client
+	mailer         *Mailer
+	publicURL      string // Base of verification links
+	linkSecret     []byte
+	sso            *ssoCache
+	peers          Peers // Modules of the other guilds, for trust groups
+	reevaluating   atomic.Bool
+	sweeping       atomic.Bool // A Sweep is running
+	lastSweep      time.Time   // Of the member list, guarded by sweeping
 	repo           *Repository
 	log            *zerolog.Logger
 }
@@ -30,6 +137,8 @@ type Verification struct {
 const (
 	name        = "Verification"
 	description = "Protect against raids!"
+
+	defaultSenderAddress = "forkman@devil2devil.asu.edu"
 )
 
 var (
@@ -43,7 +152,10 @@ func New(
 	appId string,
 	session *discordgo.Session,
 	db *gorm.DB,
-	email *ses.Client,
+	mailer *Mailer,
+	publicURL string,
+	linkSecret []byte,
+	peers Peers,
 	log *zerolog.Logger,
 ) *Verification {
 	l := log.With().
@@ -57,7 +169,11 @@ func New(
 		guildSnowflake: guildSnowflake,
 		appId:          appId,
 		session:        session,
-		emailClient:    email,
+		mailer:         mailer,
+		publicURL:      publicURL,
+		linkSecret:     linkSecret,
+		sso:            &ssoCache{},
+		peers:          peers,
 		repo:           NewRepository(db),
 		log:            &l,
 	}
@@ -68,8 +184,8 @@ func (m *Verification) Load() error {
 	if err == gorm.ErrRecordNotFound {
 		m.log.Debug().Msg("module not found, creating...")
 
-		// Default general config (empty)
-		cfgJson, _ := json.Marshal(VerificationConfig{Provider: "", SenderAddress: ""})
+		// Default general config
+		cfgJson, _ := json.Marshal(defaultConfig())
 
 		// Default command config (all enabled)
 		cmdMap := make(map[string]bool)
@@ -115,6 +231,11 @@ func (m *Verification) Load() error {
 		}
 	}
 
+	err = m.encryptSecret(mod)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt sso client secret: %w", err)
+	}
+
 	// If we are not enabled, don't do anything!
 	if !mod.Enabled {
 		m.log.Debug().Msg("module disabled, skipping...")
@@ -250,6 +371,92 @@ func (m *Verification) Status() (bool, error) {
 	return true, nil
 }
 
+// encryptSecret re-saves the config when its secret was stored in plain text
+// or with an older key.
+func (m *Verification) encryptSecret(mod *database.Module) error {
+	stored := &VerificationConfig{}
+	err := json.Unmarshal([]byte(mod.Config), stored)
+	if err != nil {
+		return fmt.Errorf("critical error unmarshalling config json: %w", err)
+	}
+
+	if database.CurrentString(stored.SSOClientSecret) {
+		return nil
+	}
+
+	cfg, err := m.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	return m.UpdateConfig(cfg)
+}
+
+// Redacted is the config without its secrets, to send back to the dashboard.
+func (c *VerificationConfig) Redacted() *VerificationConfig {
+	redacted := *c
+	redacted.SSOClientSecret = ""
+	return &redacted
+}
+
+func (m *Verification) ReadConfig() (*VerificationConfig, error) {
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the defaults so fields missing from older configs are filled in
+	cfg := defaultConfig()
+	err = json.Unmarshal([]byte(mod.Config), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("critical error unmarshalling config json: %w", err)
+	}
+
+	// Guilds created before the sender was configurable stored it empty
+	if cfg.SenderAddress == "" {
+		cfg.SenderAddress = defaultSenderAddress
+	}
+
+	cfg.SSOClientSecret, err = database.DecryptString(cfg.SSOClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("critical error decrypting sso client secret: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (m *Verification) UpdateConfig(cfg *VerificationConfig) error {
+	prev, err := m.ReadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.UnverifiedSince = unverifiedSince(prev, cfg)
+
+	mod, err := m.repo.ReadModule(m.guildSnowflake)
+	if err != nil {
+		return err
+	}
+
+	// The secret is encrypted at rest like the emails are
+	stored := *cfg
+	stored.SSOClientSecret, err = database.EncryptString(cfg.SSOClientSecret)
+	if err != nil {
+		return fmt.Errorf("critical error encrypting sso client secret: %w", err)
+	}
+
+	mod.Config, err = json.Marshal(&stored)
+	if err != nil {
+		return fmt.Errorf("critical error marshalling config json: %w", err)
+	}
+
+	_, err = m.repo.UpdateModule(mod)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (m *Verification) OnInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	mod, err := m.repo.ReadModule(i.GuildID)
 	if err != nil {
@@ -279,6 +486,21 @@ func (m *Verification) handleCommand(s *discordgo.Session, i *discordgo.Interact
 		m.email(s, i)
 	case "verify":
 		m.verify(s, i)
+	case "unverify":
+		m.unverify(s, i)
+	case "verification":
+		m.handleSubcommand(s, i)
+	}
+}
+
+func (m *Verification) handleSubcommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	name := i.ApplicationCommandData().Options[0].Name
+
+	switch name {
+	case "duplicates":
+		m.duplicates(s, i)
+	default:
+		m.log.Info().Msg("subcommand not found")
 	}
 }
 
@@ -289,6 +511,16 @@ func (m *Verification) handleComponent(s *discordgo.Session, i *discordgo.Intera
 		m.handleCIDVerifyEmailBtn(s, i)
 	case CIDVerifyEmailCodeBtn:
 		m.handleCIDVerifyEmailCodeBtn(s, i)
+	case CIDVerifyExistingBtn:
+		m.handleCIDVerifyExistingBtn(s, i)
+	case CIDReviewRequestBtn:
+		m.handleCIDReviewRequestBtn(s, i)
+	case CIDReviewApproveBtn:
+		m.handleCIDReviewApproveBtn(s, i)
+	case CIDReviewDenyBtn:
+		m.handleCIDReviewDenyBtn(s, i)
+	case CIDReviewAskBtn:
+		m.handleCIDReviewAskBtn(s, i)
 	default:
 		m.log.Error().
 			Str("custom_id", cid).
@@ -303,9 +535,40 @@ func (m *Verification) handleModal(s *discordgo.Session, i *discordgo.Interactio
 		m.handleCIDVerifyEmailModal(s, i)
 	case CIDVerifyEmailCodeModal:
 		m.handleCIDVerifyEmailCodeModal(s, i)
+	case CIDReviewRequestModal:
+		m.handleCIDReviewRequestModal(s, i)
+	case CIDReviewDenyModal:
+		m.handleCIDReviewDenyModal(s, i)
+	case CIDReviewAskModal:
+		m.handleCIDReviewAskModal(s, i)
 	default:
 		m.log.Error().
 			Str("custom_id", cid).
 			Msg("unhandled interaction")
 	}
 }
+
+// defaultConfig keeps the environment roles and log channel as the defaults
+// so existing deployments behave the same.
+func defaultConfig() *VerificationConfig {
+	return &VerificationConfig{
+		SenderAddress:        defaultSenderAddress,
+		PanelTitle:           "Verification",
+		PanelDescription:     "This Discord is for students admitted to Arizona State University. To get access to the full server please verify you've been accepted into Arizona State University.",
+		PanelColor:           0x00FF00, // Green color
+		PanelButtonLabel:     "Verify Me",
+		Mode:                 ModeCode,
+		LinkExpiryMinutes:    30,
+		DuplicatePolicy:      DuplicateAlert,
+		DuplicateLimit:       2,
+		ReverifyReminderDays: []int{7, 1},
+		UnverifiedAction:     UnverifiedKick,
+		SendCooldownSeconds:  60,
+		UserSendsPerHour:     5,
+		GuildSendsPerHour:    200,
+		AddressSendsPerDay:   5,
+		RoleToAdd:            os.Getenv("ROLE_TO_ADD"),
+		RoleToRemove:         os.Getenv("ROLE_TO_REMOVE"),
+		LogChannelID:         os.Getenv("LOG_CHANNEL_ID"),
+	}
+}
@@ -37,3 +37,18 @@ func BadRequest(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusBadRequest)
 	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
 }
+
+func NotFound(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func Conflict(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func Forbidden(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/avvo-na/forkman/internal/discord/verification"
+	e "github.com/avvo-na/forkman/internal/server/common/err"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// maxNotificationBytes bounds SNS messages, which are at most 256KB
+const maxNotificationBytes = 512 << 10
+
+var snsClient = &http.Client{Timeout: 10 * time.Second}
+
+// snsMessage is the envelope SNS posts to HTTP subscriptions.
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// sesNotification is an SES bounce or complaint notification.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Bounce           struct {
+		BounceType        string         `json:"bounceType"`
+		BouncedRecipients []sesRecipient `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []sesRecipient `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+type sesRecipient struct {
+	EmailAddress string `json:"emailAddress"`
+}
+
+// sesNotifications godoc
+//
+//	@summary Receive SES feedback
+//	@description SNS subscription for SES bounce and complaint notifications, which trip the verification email circuit breaker.
+//	@tags verification
+//	@router /verify/ses/{token} [post]
+func (s *Server) sesNotifications(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With().Str("request_id", middleware.GetReqID(r.Context())).Logger()
+
+	token := chi.URLParam(r, "token")
+	if s.cfg.SESNotificationToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.SESNotificationToken)) != 1 {
+		e.NotFound(w, errors.New("not found"))
+		return
+	}
+
+	msg := &snsMessage{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotificationBytes)).Decode(msg)
+	if err != nil {
+		e.BadRequest(w, err)
+		return
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		err = confirmSubscription(msg.SubscribeURL)
+		if err != nil {
+			log.Error().Err(err).Msg("error confirming sns subscription")
+			e.BadRequest(w, err)
+			return
+		}
+		log.Info().Msg("confirmed ses notification subscription")
+	case "Notification":
+		n := &sesNotification{}
+		err = json.Unmarshal([]byte(msg.Message), n)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+
+		kind, addresses := "", []string{}
+		switch n.NotificationType {
+		case "Bounce":
+			// Transient bounces, like full inboxes, aren't held against us
+			if n.Bounce.BounceType != "Permanent" {
+				break
+			}
+			kind = verification.FeedbackBounce
+			for _, recipient := range n.Bounce.BouncedRecipients {
+				addresses = append(addresses, recipient.EmailAddress)
+			}
+		case "Complaint":
+			kind = verification.FeedbackComplaint
+			for _, recipient := range n.Complaint.ComplainedRecipients {
+				addresses = append(addresses, recipient.EmailAddress)
+			}
+		}
+
+		if kind != "" {
+			err = verification.RecordMailFeedback(s.db, kind, addresses)
+			if err != nil {
+				log.Error().Err(err).Msg("critical error inserting mail feedback into database")
+				e.ServerError(w, err)
+				return
+			}
+			log.Info().Str("kind", kind).Int("recipients", len(addresses)).Msg("received ses feedback")
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{ "message": "Notification received." }`))
+}
+
+// confirmSubscription visits the subscribe URL, only if it points at SNS.
+func confirmSubscription(subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return errors.New("subscribe url is not an sns url")
+	}
+
+	res, err := snsClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("sns refused the subscription: " + res.Status)
+	}
+
+	return nil
+}
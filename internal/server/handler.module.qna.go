@@ -1,12 +1,17 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/avvo-na/forkman/internal/database"
 	"github.com/avvo-na/forkman/internal/discord/moderation"
+	"github.com/avvo-na/forkman/internal/discord/qna"
 	e "github.com/avvo-na/forkman/internal/server/common/err"
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
@@ -91,3 +96,493 @@ func (s *Server) statusQNAModule(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf(`{ "message": "QNA", "status": %t }`, status)))
 }
+
+func (s *Server) readQNAConfig(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	cfg, err := mod.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cfg)
+}
+
+func (s *Server) updateQNAConfig(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	// Decode on top of the current config so omitted fields are kept
+	cfg, err := mod.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(cfg)
+	if err != nil {
+		e.BadRequest(w, err)
+		return
+	}
+
+	err = s.valid.Struct(cfg)
+	if err != nil {
+		e.ValidationError(w, err)
+		return
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		e.ValidationError(w, err)
+		return
+	}
+
+	err = mod.UpdateConfig(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cfg)
+}
+
+type escalationResponse struct {
+	ID                 uint       `json:"id"`
+	ChannelSnowflake   string     `json:"channel_snowflake"`
+	RequesterSnowflake string     `json:"requester_snowflake"`
+	HelperSnowflake    string     `json:"helper_snowflake"`
+	Status             string     `json:"status"`
+	Reminders          int        `json:"reminders"`
+	AgeSeconds         int        `json:"age_seconds"`
+	ClaimedAt          *time.Time `json:"claimed_at"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+func (s *Server) listQNAEscalations(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	escs, err := mod.UnresolvedEscalations()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown escalation listing error")
+		e.ServerError(w, err)
+		return
+	}
+
+	ret := []escalationResponse{}
+	for _, esc := range escs {
+		ret = append(ret, escalationResponse{
+			ID:                 esc.ID,
+			ChannelSnowflake:   esc.ChannelSnowflake,
+			RequesterSnowflake: esc.RequesterSnowflake,
+			HelperSnowflake:    esc.HelperSnowflake,
+			Status:             esc.Status,
+			Reminders:          esc.Reminders,
+			AgeSeconds:         int(time.Since(esc.CreatedAt).Seconds()),
+			ClaimedAt:          esc.ClaimedAt,
+			CreatedAt:          esc.CreatedAt,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ret)
+}
+
+type usageResponse struct {
+	From         time.Time         `json:"from"`
+	To           time.Time         `json:"to"`
+	Interval     string            `json:"interval"`
+	InputTokens  int               `json:"input_tokens"`
+	OutputTokens int               `json:"output_tokens"`
+	Buckets      []qna.UsageBucket `json:"buckets"`
+}
+
+func (s *Server) readQNAUsage(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	// Defaults to the last 30 days, per day
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	interval := qna.IntervalDay
+
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		from, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		to, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+		to = to.AddDate(0, 0, 1) // Inclusive of the whole day
+	}
+	if v := q.Get("interval"); v != "" {
+		if v != qna.IntervalDay && v != qna.IntervalMonth {
+			e.BadRequest(w, fmt.Errorf("interval must be %s or %s", qna.IntervalDay, qna.IntervalMonth))
+			return
+		}
+		interval = v
+	}
+
+	buckets, err := mod.Usage(from, to, interval)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown usage reporting error")
+		e.ServerError(w, err)
+		return
+	}
+
+	ret := usageResponse{
+		From:     from,
+		To:       to,
+		Interval: interval,
+		Buckets:  buckets,
+	}
+	for _, b := range buckets {
+		ret.InputTokens += b.InputTokens
+		ret.OutputTokens += b.OutputTokens
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ret)
+}
+
+type faqRequest struct {
+	Key     string   `json:"key" validate:"required,max=100"`
+	Title   string   `json:"title" validate:"required,max=256"`
+	Body    string   `json:"body" validate:"required,max=4096"`
+	Aliases []string `json:"aliases" validate:"max=25,dive,required,max=100"`
+}
+
+type faqResponse struct {
+	Key       string    `json:"key"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Aliases   []string  `json:"aliases"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newFaqResponse(entry *database.FaqEntry) faqResponse {
+	aliases := []string(entry.Aliases)
+	if aliases == nil {
+		aliases = []string{}
+	}
+
+	return faqResponse{
+		Key:       entry.Key,
+		Title:     entry.Title,
+		Body:      entry.Body,
+		Aliases:   aliases,
+		CreatedAt: entry.CreatedAt,
+		UpdatedAt: entry.UpdatedAt,
+	}
+}
+
+func (s *Server) decodeFaqRequest(w http.ResponseWriter, r *http.Request) (*database.FaqEntry, bool) {
+	req := &faqRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		e.BadRequest(w, err)
+		return nil, false
+	}
+
+	err = s.valid.Struct(req)
+	if err != nil {
+		e.ValidationError(w, err)
+		return nil, false
+	}
+
+	return &database.FaqEntry{
+		Key:     req.Key,
+		Title:   req.Title,
+		Body:    req.Body,
+		Aliases: req.Aliases,
+	}, true
+}
+
+func (s *Server) listQNAFaq(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	entries, err := mod.Faq()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown faq listing error")
+		e.ServerError(w, err)
+		return
+	}
+
+	ret := []faqResponse{}
+	for _, entry := range entries {
+		ret = append(ret, newFaqResponse(&entry))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ret)
+}
+
+func (s *Server) readQNAFaq(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	key := chi.URLParam(r, "key")
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	entry, err := mod.ReadFaq(key)
+	if err != nil {
+		if errors.Is(err, qna.ErrFaqNotFound) {
+			e.NotFound(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown faq reading error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newFaqResponse(entry))
+}
+
+func (s *Server) createQNAFaq(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	entry, ok := s.decodeFaqRequest(w, r)
+	if !ok {
+		return
+	}
+
+	entry, err = mod.CreateFaq(entry)
+	if err != nil {
+		if errors.Is(err, qna.ErrFaqConflict) {
+			e.Conflict(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown faq creation error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newFaqResponse(entry))
+}
+
+func (s *Server) updateQNAFaq(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	key := chi.URLParam(r, "key")
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	entry, ok := s.decodeFaqRequest(w, r)
+	if !ok {
+		return
+	}
+
+	entry, err = mod.UpdateFaq(key, entry)
+	if err != nil {
+		switch {
+		case errors.Is(err, qna.ErrFaqNotFound):
+			e.NotFound(w, err)
+		case errors.Is(err, qna.ErrFaqConflict):
+			e.Conflict(w, err)
+		default:
+			log.Error().Err(err).Msg("unknown faq update error")
+			e.ServerError(w, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newFaqResponse(entry))
+}
+
+func (s *Server) deleteQNAFaq(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	key := chi.URLParam(r, "key")
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	err = mod.DeleteFaq(key)
+	if err != nil {
+		if errors.Is(err, qna.ErrFaqNotFound) {
+			e.NotFound(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown faq deletion error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{ "message": "Successfully deleted FAQ entry." }`))
+}
+
+type promptPreviewRequest struct {
+	Question string          `json:"question" validate:"required,max=1000"`
+	Config   json.RawMessage `json:"config"` // Unsaved changes to preview, optional
+}
+
+type promptPreviewResponse struct {
+	Prompt   string `json:"prompt"`
+	Greeting string `json:"greeting"`
+}
+
+func (s *Server) previewQNAPrompt(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetQNAModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	req := &promptPreviewRequest{}
+	err = json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		e.BadRequest(w, err)
+		return
+	}
+
+	err = s.valid.Struct(req)
+	if err != nil {
+		e.ValidationError(w, err)
+		return
+	}
+
+	cfg, err := mod.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	if len(req.Config) != 0 {
+		err = json.Unmarshal(req.Config, cfg)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+
+		err = s.valid.Struct(cfg)
+		if err != nil {
+			e.ValidationError(w, err)
+			return
+		}
+
+		err = cfg.Validate()
+		if err != nil {
+			e.ValidationError(w, err)
+			return
+		}
+	}
+
+	prompt, err := mod.PreviewPrompt(cfg, req.Question)
+	if err != nil {
+		if errors.Is(err, qna.ErrBlockedTopic) {
+			e.ValidationError(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown prompt preview error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(promptPreviewResponse{
+		Prompt:   prompt,
+		Greeting: mod.PreviewGreeting(cfg),
+	})
+}
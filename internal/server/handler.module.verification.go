@@ -1,11 +1,16 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/avvo-na/forkman/internal/discord/moderation"
+	"github.com/avvo-na/forkman/internal/discord/verification"
 	e "github.com/avvo-na/forkman/internal/server/common/err"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -116,3 +121,660 @@ func (s *Server) statusVerificationModule(w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusOK)
   w.Write([]byte(fmt.Sprintf(`{ "message": "Verification", "status": %t }`, status)))
 }
+
+func (s *Server) readVerificationConfig(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	cfg, err := mod.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cfg.Redacted())
+}
+
+func (s *Server) updateVerificationConfig(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	// Decode on top of the current config so omitted fields are kept
+	cfg, err := mod.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	secret := cfg.SSOClientSecret
+	err = json.NewDecoder(r.Body).Decode(cfg)
+	if err != nil {
+		e.BadRequest(w, err)
+		return
+	}
+
+	// The secret is never sent out, an empty one means leave it be
+	if cfg.SSOClientSecret == "" {
+		cfg.SSOClientSecret = secret
+	}
+
+	err = s.valid.Struct(cfg)
+	if err != nil {
+		e.ValidationError(w, err)
+		return
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		e.ValidationError(w, err)
+		return
+	}
+
+	err = mod.UpdateConfig(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown module config error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cfg.Redacted())
+}
+
+func (s *Server) reevaluateVerificationRoles(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	err = mod.ReevaluateRoles()
+	if err != nil {
+		if errors.Is(err, verification.ErrReevaluationRunning) {
+			e.Conflict(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown role re-evaluation error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{ "message": "Re-evaluating roles, a summary will be posted to the log channel." }`))
+}
+
+func (s *Server) listVerificationDuplicates(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	dups, err := mod.Duplicates()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown duplicate listing error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(dups)
+}
+
+type unverifyRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (s *Server) unverifyVerificationUser(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	userId := chi.URLParam(r, "userId")
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Str("user_id", userId).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	// The body is optional
+	req := &unverifyRequest{}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+	}
+
+	err = mod.Unverify(userId, req.Reason)
+	if err != nil {
+		if errors.Is(err, verification.ErrNotVerified) {
+			e.NotFound(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown unverify error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{ "message": "Successfully unverified user." }`))
+}
+
+func (s *Server) previewUnverifiedSweep(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	plan, err := mod.PreviewUnverified()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown unverified sweep preview error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (s *Server) listVerificationReviews(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", verification.ReviewPending, verification.ReviewInfoRequested, verification.ReviewApproved, verification.ReviewDenied:
+	default:
+		e.BadRequest(w, fmt.Errorf("unknown review status %s", status))
+		return
+	}
+
+	reviews, err := mod.Reviews(status)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown review listing error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// maxImportBytes bounds import bodies, a record is well under 200 bytes
+const maxImportBytes = 10 << 20
+
+func (s *Server) exportVerificationRecords(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		e.BadRequest(w, fmt.Errorf("unknown export format %s", format))
+		return
+	}
+
+	addresses := q.Get("addresses")
+	switch addresses {
+	case "":
+		addresses = verification.AddressesPlain
+	case verification.AddressesPlain, verification.AddressesRedact, verification.AddressesHash:
+	default:
+		e.BadRequest(w, fmt.Errorf("unknown addresses option %s", addresses))
+		return
+	}
+
+	records, err := mod.Export(addresses)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown verification export error")
+		e.ServerError(w, err)
+		return
+	}
+
+	filename := fmt.Sprintf("verification-%s.%s", gs, format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = verification.WriteRecordsCSV(w, records)
+		if err != nil {
+			log.Error().Err(err).Msg("error writing verification export")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(records)
+}
+
+func (s *Server) importVerificationRecords(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	dryRun := q.Get("dry_run") == "true"
+	applyRoles := q.Get("apply_roles") == "true"
+
+	// CSV in the export format, JSON otherwise
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	records := []verification.EmailRecord{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		records, err = verification.ReadRecordsCSV(body)
+	} else {
+		err = json.NewDecoder(body).Decode(&records)
+	}
+	if err != nil {
+		e.BadRequest(w, err)
+		return
+	}
+
+	report, err := mod.Import(records, dryRun, applyRoles)
+	if err != nil {
+		if errors.Is(err, verification.ErrRolesBusy) {
+			e.Conflict(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown verification import error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Server) readVerificationPanel(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	panel, err := mod.Panel()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown panel status error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(panel)
+}
+
+func (s *Server) editVerificationPanel(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	err = mod.EditVerificationPanel()
+	if err != nil {
+		if errors.Is(err, verification.ErrPanelNotFound) {
+			e.NotFound(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown panel edit error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{ "message": "Successfully edited email verification panel." }`))
+}
+
+func (s *Server) deleteVerificationPanel(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	err = mod.DeleteVerificationPanel()
+	if err != nil {
+		if errors.Is(err, verification.ErrPanelNotFound) {
+			e.NotFound(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown panel deletion error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{ "message": "Successfully deleted email verification panel." }`))
+}
+
+type verificationStatsResponse struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	*verification.Stats
+}
+
+func (s *Server) readVerificationStats(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	// Defaults to the last 30 days
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		from, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		to, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+		to = to.AddDate(0, 0, 1) // Inclusive of the whole day
+	}
+
+	stats, err := mod.Stats(from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown verification stats error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(verificationStatsResponse{From: from, To: to, Stats: stats})
+}
+
+type createTrustGroupRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+func (s *Server) listTrustGroups(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	groups, err := mod.TrustGroups()
+	if err != nil {
+		log.Error().Err(err).Msg("unknown trust group listing error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(groups)
+}
+
+func (s *Server) createTrustGroup(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	req := &createTrustGroupRequest{}
+	err = json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		e.BadRequest(w, err)
+		return
+	}
+
+	err = s.valid.Struct(req)
+	if err != nil {
+		e.ValidationError(w, err)
+		return
+	}
+
+	group, err := mod.CreateTrustGroup(req.Name)
+	if err != nil {
+		log.Error().Err(err).Msg("unknown trust group creation error")
+		e.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+func (s *Server) inviteToTrustGroup(w http.ResponseWriter, r *http.Request) {
+	s.changeTrustGroup(w, r, "Successfully invited guild to trust group.", func(mod *verification.Verification, groupID uint) error {
+		return mod.InviteToTrustGroup(groupID, chi.URLParam(r, "guildId"))
+	})
+}
+
+func (s *Server) acceptTrustGroup(w http.ResponseWriter, r *http.Request) {
+	s.changeTrustGroup(w, r, "Successfully joined trust group.", func(mod *verification.Verification, groupID uint) error {
+		return mod.AcceptTrustGroup(groupID)
+	})
+}
+
+func (s *Server) leaveTrustGroup(w http.ResponseWriter, r *http.Request) {
+	s.changeTrustGroup(w, r, "Successfully left trust group.", func(mod *verification.Verification, groupID uint) error {
+		return mod.LeaveTrustGroup(groupID)
+	})
+}
+
+func (s *Server) removeFromTrustGroup(w http.ResponseWriter, r *http.Request) {
+	s.changeTrustGroup(w, r, "Successfully removed guild from trust group.", func(mod *verification.Verification, groupID uint) error {
+		return mod.RemoveFromTrustGroup(groupID, chi.URLParam(r, "guildId"))
+	})
+}
+
+// changeTrustGroup runs a change to the trust group in the URL, mapping the
+// module's errors to responses.
+func (s *Server) changeTrustGroup(
+	w http.ResponseWriter,
+	r *http.Request,
+	message string,
+	change func(mod *verification.Verification, groupID uint) error,
+) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Str("group_id", chi.URLParam(r, "groupId")).
+		Logger()
+
+	groupID, err := strconv.ParseUint(chi.URLParam(r, "groupId"), 10, 0)
+	if err != nil {
+		e.BadRequest(w, fmt.Errorf("invalid trust group id: %w", err))
+		return
+	}
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	err = change(mod, uint(groupID))
+	if err != nil {
+		switch {
+		case errors.Is(err, verification.ErrTrustGroupNotFound), errors.Is(err, verification.ErrUnknownGuild):
+			e.NotFound(w, err)
+		case errors.Is(err, verification.ErrNotGroupOwner):
+			e.Forbidden(w, err)
+		case errors.Is(err, verification.ErrAlreadyInGroup):
+			e.Conflict(w, err)
+		default:
+			log.Error().Err(err).Msg("unknown trust group error")
+			e.ServerError(w, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func (s *Server) previewVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	gs := r.Context().Value("guildSnowflake").(string)
+	log := s.log.With().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("guild_snowflake", gs).
+		Logger()
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		e.ServerError(w, err)
+		return
+	}
+
+	// Templates in the body are previewed in place of the saved ones
+	var override *verification.EmailTemplates
+	if r.ContentLength != 0 {
+		override = &verification.EmailTemplates{}
+		err = json.NewDecoder(r.Body).Decode(override)
+		if err != nil {
+			e.BadRequest(w, err)
+			return
+		}
+	}
+
+	msg, err := mod.PreviewEmail(override)
+	if err != nil {
+		if errors.Is(err, verification.ErrInvalidEmailTemplate) {
+			e.ValidationError(w, err)
+			return
+		}
+		log.Error().Err(err).Msg("unknown email preview error")
+		e.ServerError(w, err)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "html":
+		// Templates are written by staff, don't let one run scripts here
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg.HTML))
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg.Text))
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(msg)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/avvo-na/forkman/internal/discord/verification"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/markbates/goth/gothic"
+	"github.com/rs/zerolog"
+)
+
+var verifyTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{ .Title }}</title>
+	<style>
+		body { font-family: sans-serif; background: #8c1d40; color: #fff; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; }
+		main { background: #fff; color: #222; border-radius: 8px; padding: 2rem 3rem; max-width: 32rem; text-align: center; }
+		button { background: #8c1d40; color: #fff; border: 0; border-radius: 4px; padding: 0.75rem 1.5rem; font-size: 1rem; cursor: pointer; }
+	</style>
+</head>
+<body>
+	<main>
+		<h1>{{ .Title }}</h1>
+		<p>{{ .Message }}</p>
+		{{ if .Confirm }}
+		<form method="post">
+			<button type="submit">{{ .Confirm }}</button>
+		</form>
+		{{ end }}
+	</main>
+</body>
+</html>
+`))
+
+var duplicateMessage = "That email is already used to verify another account. If you think this is a mistake, please reach out to a moderator."
+
+type verifyPageData struct {
+	Title   string
+	Message string
+	Confirm string // Label of a button posting back to the page, if any
+}
+
+func (s *Server) verifyPage(w http.ResponseWriter, status int, title string, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	verifyTemplate.Execute(w, verifyPageData{Title: title, Message: message})
+}
+
+// verifyLink godoc
+//
+//	@summary Open a verification link
+//	@description Checks a signed verification link and asks to confirm it. Mail scanners open every link in an email, so opening one never verifies.
+//	@tags verification
+//	@router /verify/{token} [get]
+func (s *Server) verifyLink(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	log := s.log.With().Str("request_id", middleware.GetReqID(r.Context())).Logger()
+
+	mod, gs, ok := s.linkModule(w, token)
+	if !ok {
+		return
+	}
+
+	email, err := mod.CheckLink(token)
+	if err == nil && verification.LinkConfirmed(email) {
+		s.verifyPage(w, http.StatusOK, "You're verified!", "You've already verified your email, you can close this page and head back to Discord.")
+		return
+	}
+	if err != nil {
+		s.linkError(w, log, gs, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	verifyTemplate.Execute(w, verifyPageData{
+		Title:   "Verify your email",
+		Message: "Confirm that you requested to verify this email in Discord. If you didn't, you can ignore this page.",
+		Confirm: "Verify My Email",
+	})
+}
+
+// confirmVerifyLink godoc
+//
+//	@summary Verify an email through a link
+//	@description Checks a signed verification link, verifies the email and applies the roles.
+//	@tags verification
+//	@router /verify/{token} [post]
+func (s *Server) confirmVerifyLink(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	log := s.log.With().Str("request_id", middleware.GetReqID(r.Context())).Logger()
+
+	mod, gs, ok := s.linkModule(w, token)
+	if !ok {
+		return
+	}
+
+	_, err := mod.VerifyLink(token)
+	if err != nil {
+		s.linkError(w, log, gs, err)
+		return
+	}
+
+	s.verifyPage(w, http.StatusOK, "You're verified!", "Thank you for verifying your email with us! You now have access to our community, you can close this page and head back to Discord.")
+}
+
+// linkModule finds the module a link was issued by, rendering the error page
+// when it can't.
+func (s *Server) linkModule(w http.ResponseWriter, token string) (*verification.Verification, string, bool) {
+	gs, err := verification.LinkGuild(token)
+	if err != nil {
+		s.verifyPage(w, http.StatusBadRequest, "Invalid link", "This verification link is invalid. Please request a new one from the verification panel in Discord.")
+		return nil, "", false
+	}
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		s.verifyPage(w, http.StatusNotFound, "Invalid link", "This verification link is for a server Forkman is no longer in.")
+		return nil, "", false
+	}
+
+	return mod, gs, true
+}
+
+func (s *Server) linkError(w http.ResponseWriter, log zerolog.Logger, gs string, err error) {
+	switch {
+	case errors.Is(err, verification.ErrExpiredLink):
+		s.verifyPage(w, http.StatusGone, "Link expired", "This verification link has expired. Please request a new one from the verification panel in Discord.")
+	case errors.Is(err, verification.ErrInvalidLink):
+		s.verifyPage(w, http.StatusBadRequest, "Invalid link", "This verification link is invalid or has been replaced by a newer one. Please use the latest email we sent you.")
+	case errors.Is(err, verification.ErrDuplicateEmail):
+		s.verifyPage(w, http.StatusConflict, "Email already in use", duplicateMessage)
+	default:
+		log.Error().Err(err).Str("guild_snowflake", gs).Msg("unknown link verification error")
+		s.verifyPage(w, http.StatusInternalServerError, "Something went wrong", "We couldn't verify your email, please try again later.")
+	}
+}
+
+var ssoSessionKey = "forkman-sso-session"
+
+// verifySSOLogin godoc
+//
+//	@summary Start an SSO verification
+//	@description Checks a signed SSO link and redirects to the guild's identity provider.
+//	@tags verification
+//	@router /verify/sso/{token} [get]
+func (s *Server) verifySSOLogin(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	log := s.log.With().Str("request_id", middleware.GetReqID(r.Context())).Logger()
+
+	gs, err := verification.LinkGuild(token)
+	if err != nil {
+		s.verifyPage(w, http.StatusBadRequest, "Invalid link", "This sign in link is invalid. Please use the verification panel in Discord again.")
+		return
+	}
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		s.verifyPage(w, http.StatusNotFound, "Invalid link", "This sign in link is for a server Forkman is no longer in.")
+		return
+	}
+
+	url, session, err := mod.SSOLogin(token)
+	switch {
+	case errors.Is(err, verification.ErrExpiredLink):
+		s.verifyPage(w, http.StatusGone, "Link expired", "This sign in link has expired. Please use the verification panel in Discord again.")
+		return
+	case errors.Is(err, verification.ErrInvalidLink):
+		s.verifyPage(w, http.StatusBadRequest, "Invalid link", "This sign in link is invalid. Please use the verification panel in Discord again.")
+		return
+	case errors.Is(err, verification.ErrSSONotConfigured):
+		s.verifyPage(w, http.StatusNotFound, "Not available", "This server doesn't verify through a university login anymore. Please use the verification panel in Discord again.")
+		return
+	case err != nil:
+		log.Error().Err(err).Str("guild_snowflake", gs).Msg("unknown sso login error")
+		s.verifyPage(w, http.StatusBadGateway, "Something went wrong", "We couldn't reach the university login, please try again later.")
+		return
+	}
+
+	// Keep the provider session until the callback, the state ties it to this browser
+	sess, _ := gothic.Store.Get(r, ssoSessionKey)
+	sess.Values["state"] = token
+	sess.Values["session"] = session
+	err = sess.Save(r, w)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to save sso session")
+		s.verifyPage(w, http.StatusInternalServerError, "Something went wrong", "We couldn't start the sign in, please try again later.")
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+// verifySSOCallback godoc
+//
+//	@summary Callback from an SSO verification
+//	@description Completes the login with the identity provider and verifies the Discord user.
+//	@tags verification
+//	@router /verify/sso/callback [get]
+func (s *Server) verifySSOCallback(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With().Str("request_id", middleware.GetReqID(r.Context())).Logger()
+
+	sess, _ := gothic.Store.Get(r, ssoSessionKey)
+	token, _ := sess.Values["state"].(string)
+	session, _ := sess.Values["session"].(string)
+	if token == "" || session == "" || r.URL.Query().Get("state") != token {
+		s.verifyPage(w, http.StatusBadRequest, "Invalid sign in", "We couldn't match this sign in to a verification. Please use the verification panel in Discord again.")
+		return
+	}
+
+	// Sessions are single use
+	delete(sess.Values, "state")
+	delete(sess.Values, "session")
+	sess.Save(r, w)
+
+	gs, err := verification.LinkGuild(token)
+	if err != nil {
+		s.verifyPage(w, http.StatusBadRequest, "Invalid sign in", "We couldn't match this sign in to a verification. Please use the verification panel in Discord again.")
+		return
+	}
+
+	mod, err := s.discord.GetVerificationModule(gs)
+	if err != nil {
+		s.verifyPage(w, http.StatusNotFound, "Invalid sign in", "This sign in is for a server Forkman is no longer in.")
+		return
+	}
+
+	_, err = mod.CompleteSSO(token, session, r.URL.Query())
+	switch {
+	case errors.Is(err, verification.ErrExpiredLink):
+		s.verifyPage(w, http.StatusGone, "Link expired", "This sign in took too long. Please use the verification panel in Discord again.")
+	case errors.Is(err, verification.ErrDuplicateEmail):
+		s.verifyPage(w, http.StatusConflict, "Email already in use", duplicateMessage)
+	case errors.Is(err, verification.ErrSSONoEmail):
+		s.verifyPage(w, http.StatusForbidden, "Missing email", "Your university login didn't share an email address with us, so we couldn't verify you.")
+	case errors.Is(err, verification.ErrSSOUnverified):
+		s.verifyPage(w, http.StatusForbidden, "Unverified email", "Your university login hasn't confirmed your email address yet, so we couldn't verify you.")
+	case err != nil:
+		log.Error().Err(err).Str("guild_snowflake", gs).Msg("unknown sso callback error")
+		s.verifyPage(w, http.StatusInternalServerError, "Something went wrong", "We couldn't verify your login, please try again later.")
+	default:
+		s.verifyPage(w, http.StatusOK, "You're verified!", "Thank you for verifying with us! You now have access to our community, you can close this page and head back to Discord.")
+	}
+}
@@ -42,6 +42,13 @@ func (s *Server) registerRoutes() http.Handler {
 	r.Get("/health", s.healthCheck)
 	r.Get("/uptime", s.uptime)
 
+	// Verification links from emails
+	r.Get("/verify/{token}", s.verifyLink)
+	r.Post("/verify/{token}", s.confirmVerifyLink)
+	r.Get("/verify/sso/callback", s.verifySSOCallback)
+	r.Get("/verify/sso/{token}", s.verifySSOLogin)
+	r.Post("/verify/ses/{token}", s.sesNotifications)
+
 	// Auth Routes
 	r.Route("/auth", func(r chi.Router) {
 		r.Get("/{provider}/login", s.authLogin)
@@ -74,12 +81,42 @@ func (s *Server) registerRoutes() http.Handler {
 			r.Post("/module/verification/enable", s.enableVerificationModule)
 			r.Post("/module/verification/disable", s.disableVerificationModule)
 			r.Post("/module/verification/panel/send/{channelId}", s.sendVerificationPanel)
+			r.Post("/module/verification/panel/edit", s.editVerificationPanel)
+			r.Get("/module/verification/panel", s.readVerificationPanel)
+			r.Delete("/module/verification/panel", s.deleteVerificationPanel)
 			r.Get("/module/verification/status", s.statusVerificationModule)
+			r.Get("/module/verification/config", s.readVerificationConfig)
+			r.Put("/module/verification/config", s.updateVerificationConfig)
+			r.Post("/module/verification/roles/reevaluate", s.reevaluateVerificationRoles)
+			r.Get("/module/verification/duplicates", s.listVerificationDuplicates)
+			r.Post("/module/verification/unverify/{userId}", s.unverifyVerificationUser)
+			r.Get("/module/verification/unverified/preview", s.previewUnverifiedSweep)
+			r.Get("/module/verification/reviews", s.listVerificationReviews)
+			r.Get("/module/verification/export", s.exportVerificationRecords)
+			r.Post("/module/verification/import", s.importVerificationRecords)
+			r.Get("/module/verification/stats", s.readVerificationStats)
+			r.Post("/module/verification/email/preview", s.previewVerificationEmail)
+			r.Get("/module/verification/trust", s.listTrustGroups)
+			r.Post("/module/verification/trust", s.createTrustGroup)
+			r.Post("/module/verification/trust/{groupId}/invite/{guildId}", s.inviteToTrustGroup)
+			r.Post("/module/verification/trust/{groupId}/accept", s.acceptTrustGroup)
+			r.Delete("/module/verification/trust/{groupId}", s.leaveTrustGroup)
+			r.Delete("/module/verification/trust/{groupId}/members/{guildId}", s.removeFromTrustGroup)
 
 			// QNA API
 			r.Post("/module/qna/enable", s.enableQNAModule)
 			r.Post("/module/qna/disable", s.disableQNAModule)
 			r.Get("/module/qna/status", s.statusQNAModule)
+			r.Get("/module/qna/config", s.readQNAConfig)
+			r.Put("/module/qna/config", s.updateQNAConfig)
+			r.Get("/module/qna/escalations", s.listQNAEscalations)
+			r.Get("/module/qna/usage", s.readQNAUsage)
+			r.Get("/module/qna/faq", s.listQNAFaq)
+			r.Post("/module/qna/faq", s.createQNAFaq)
+			r.Get("/module/qna/faq/{key}", s.readQNAFaq)
+			r.Put("/module/qna/faq/{key}", s.updateQNAFaq)
+			r.Delete("/module/qna/faq/{key}", s.deleteQNAFaq)
+			r.Post("/module/qna/prompt/preview", s.previewQNAPrompt)
 		})
 	})
 